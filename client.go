@@ -21,69 +21,387 @@ import (
 	"bytes"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	CRLF     = "\x0d\x0a"
-	BUF_SIZE = 1380
+	CRLF       = "\x0d\x0a"
+	BUF_SIZE   = 1380
+	MAX_LINE   = 512 // Max message length, including CRLF
+	USER_MODES = "Iiow"
+	// Space separated list of supported IRCv3 capabilities
+	CAPABILITIES = "away-notify batch draft/channel-rename draft/resume labeled-response message-tags multi-prefix sasl setname standard-replies userhost-in-names"
 )
 
+// Client's state is owned by Daemon's processor goroutine, except for
+// timestamp field, updated by client's own processor, and
+// labeled-response replies capturing, as rooms processors send
+// messages to client concurrently: they are guarded by client's lock.
+// Pending PING is cleared only by PONG with matching token.
 type Client struct {
+	sync.Mutex
 	hostname   string
-	conn       net.Conn
+	conn       *QueuedConn
 	registered bool
+	operator   bool
+	invisible  bool
+	idlehidden bool
+	wallops    bool
 	ping_sent  bool
+	ping_token string
+	ping_time  time.Time
 	timestamp  time.Time
+	connected  time.Time
 	nickname   string
 	username   string
 	realname   string
+	away       string
+	away_sent  map[*Client]time.Time
+	caps       map[string]bool
+	class      *ConnClass
+	// Label of client's command being processed and replies to it
+	label   string
+	labeled []string
+	// Number of batches sent to client, used as their references
+	batches int
+	// Account name client is authenticated as with SASL
+	account string
+	// SASL mechanism of authentication in progress
+	sasl_mechanism string
+	// Base64 payload of SASL authentication collected from chunks
+	sasl_payload string
+	// Number of failed SASL authentication attempts
+	sasl_failures int
+	// Password given with PASS during registration
+	password string
+	// CAP negotiation is in progress, so registration is deferred
+	cap_negotiating bool
+	// Away was set automatically because of inactivity
+	away_auto bool
+	// Last time client sent a command other than PING/PONG
+	last_activity time.Time
+	// Time client completed registration at
+	signon time.Time
+	// Buffered events queue overflow was already warned about
+	events_full bool
+	// Process too long messages truncated instead of dropping them
+	truncate_long bool
+	// Token client can resume its session with after disconnect
+	resume_token string
+	// Time connection was lost, while session is retained for resumption
+	detached time.Time
+	// Reason of connection closing announced in QUIT
+	quit_reason string
+	// QUIT was already announced, so client must not join rooms anymore
+	quitted bool
+	// Legacy charset client uses instead of UTF-8, if any
+	charset *Charset
+	// Network name of virtual host client connected to with TLS SNI
+	network string
+	// Flood control token bucket: messages allowed and its last refill
+	flood_tokens float64
+	flood_time   time.Time
+	// Times of channels creations during the last CHANCREATE_WINDOW
+	chancreates []time.Time
+	// Rooms client has joined. It is maintained by the daemon, as it
+	// sends JOINs and PARTs to rooms, so it does not lag behind rooms
+	// processors
+	rooms map[*Room]bool
 }
 
-func (client Client) String() string {
+// Client's identification with connection's address, used for logging.
+// Messages origin prefixes use Hostmask instead.
+func (client *Client) String() string {
 	return client.nickname + "!" + client.username + "@" + client.conn.RemoteAddr().String()
 }
 
+// Client's host without port, if it has any
+func (client *Client) Host() string {
+	h := client.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		return host
+	}
+	return h
+}
+
+// Client's canonical nick!user@host mask. It is the only source of
+// messages origin prefixes and is matched against bans
+func (client *Client) Hostmask() string {
+	return client.nickname + "!" + client.username + "@" + client.Host()
+}
+
+// Is client a member of the room. Room's lock must be held by caller.
+func (client *Client) RoomMember(room *Room) bool {
+	_, member := room.members[client]
+	return member
+}
+
+// All client's distinct hostmasks that bans and exceptions are matched
+// against. Hosts are neither cloaked nor resolved, so it is the single
+// real IP address based Hostmask for now
+func (client *Client) Hostmasks() []string {
+	return []string{client.Hostmask()}
+}
+
+// Take a token from client's flood control bucket, refilled with rate
+// tokens per second up to burst ones, telling if message is allowed.
+func (client *Client) FloodCheck(rate float64, burst int, now time.Time) bool {
+	client.flood_tokens += now.Sub(client.flood_time).Seconds() * rate
+	if client.flood_time.IsZero() || client.flood_tokens > float64(burst) {
+		client.flood_tokens = float64(burst)
+	}
+	client.flood_time = now
+	if client.flood_tokens < 1 {
+		return false
+	}
+	client.flood_tokens--
+	return true
+}
+
+// Register channel creation at specified time, telling if it is allowed
+// by rate limit of channels per CHANCREATE_WINDOW. Rejected creations
+// are not counted.
+func (client *Client) ChancreateCheck(rate int, now time.Time) bool {
+	since := now.Add(-CHANCREATE_WINDOW)
+	for len(client.chancreates) > 0 && !client.chancreates[0].After(since) {
+		client.chancreates = client.chancreates[1:]
+	}
+	if len(client.chancreates) >= rate {
+		return false
+	}
+	client.chancreates = append(client.chancreates, now)
+	return true
+}
+
+// WHO reply status: "G" (gone) for away client, "H" (here) otherwise
+func (client *Client) WhoStatus() string {
+	if client.away != "" {
+		return "G"
+	}
+	return "H"
+}
+
+// Client's connection class ping timeout, or default one
+func (client *Client) PingTimeout() time.Duration {
+	if client.class != nil && client.class.ping_timeout > 0 {
+		return client.class.ping_timeout
+	}
+	return PING_TIMEOUT
+}
+
+// Client's user modes, like "+iow". I hides idle time from WHOIS of
+// non-operators
+func (client *Client) Modes() string {
+	modes := "+"
+	if client.idlehidden {
+		modes += "I"
+	}
+	if client.invisible {
+		modes += "i"
+	}
+	if client.operator {
+		modes += "o"
+	}
+	if client.wallops {
+		modes += "w"
+	}
+	return modes
+}
+
+// Apply user modes change, like "+i" or "-o+i". Operator status can
+// only be dropped, not gained. Returns actually applied changes and
+// unknown mode flags.
+func (client *Client) ModesApply(change string) (applied, unknown string) {
+	adding := true
+	sign := ""
+	for _, flag := range change {
+		var changed bool
+		switch flag {
+		case '+', '-':
+			adding = flag == '+'
+			continue
+		case 'I':
+			changed = client.idlehidden != adding
+			client.idlehidden = adding
+		case 'i':
+			changed = client.invisible != adding
+			client.invisible = adding
+		case 'o':
+			changed = !adding && client.operator
+			if changed {
+				client.operator = false
+			}
+		case 'w':
+			changed = client.wallops != adding
+			client.wallops = adding
+		default:
+			unknown += string(flag)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if adding && sign != "+" {
+			sign = "+"
+			applied += sign
+		}
+		if !adding && sign != "-" {
+			sign = "-"
+			applied += sign
+		}
+		applied += string(flag)
+	}
+	return applied, unknown
+}
+
 func NewClient(hostname string, conn net.Conn) *Client {
-	return &Client{hostname: hostname, conn: conn, nickname: "*"}
+	return &Client{
+		hostname:  hostname,
+		conn:      NewQueuedConn(conn),
+		nickname:  "*",
+		connected: time.Now(),
+		away_sent: make(map[*Client]time.Time),
+		caps:      make(map[string]bool),
+		rooms:     make(map[*Room]bool),
+	}
+}
+
+// Send event to the daemon. If buffered events queue is full, then it
+// is warned once until the queue drains, and sending blocks meanwhile.
+func (client *Client) EventSend(sink chan<- ClientEvent, event ClientEvent) {
+	select {
+	case sink <- event:
+		client.events_full = false
+		return
+	default:
+	}
+	if cap(sink) > 0 && !client.events_full {
+		log.Println(client.conn.RemoteAddr(), "events queue is full, waiting")
+		client.events_full = true
+	}
+	sink <- event
 }
 
 // Client processor blockingly reads everything remote client sends,
 // splits messages by CRLF and send them to Daemon gorouting for processing
-// it futher. Also it can signalize that client is unavailable (disconnected).
+// it futher. Incomplete trailing message is kept until the rest of it is
+// read. Too long messages are either dropped or truncated, but if the
+// incomplete one exceeds BUF_SIZE, then connection is closed.
+// Also it can signalize that client is unavailable (disconnected).
 func (client *Client) Processor(sink chan<- ClientEvent) {
-	var buf_net []byte
+	buf_net := make([]byte, BUF_SIZE)
 	buf := make([]byte, 0)
-	log.Println(client, "New client")
-	sink <- ClientEvent{client, EVENT_NEW, ""}
+	log.Println(client.conn.RemoteAddr(), "New client")
+	client.EventSend(sink, ClientEvent{client, EVENT_NEW, ""})
 	for {
-		buf_net = make([]byte, BUF_SIZE)
-		_, err := client.conn.Read(buf_net)
+		n, err := client.conn.Read(buf_net)
 		if err != nil {
-			log.Println(client, "connection lost", err)
-			sink <- ClientEvent{client, EVENT_DEL, ""}
+			log.Println(client.conn.RemoteAddr(), "connection lost", err)
+			client.conn.Close()
+			client.EventSend(sink, ClientEvent{client, EVENT_DEL, ""})
 			break
 		}
+		client.Lock()
 		client.timestamp = time.Now()
-		client.ping_sent = false
-		buf_net = bytes.TrimRight(buf_net, "\x00")
-		buf = append(buf, buf_net...)
-		if !bytes.HasSuffix(buf, []byte(CRLF)) {
-			continue
-		}
-		for _, msg := range bytes.Split(buf[:len(buf)-2], []byte(CRLF)) {
-			if len(msg) > 0 {
-				sink <- ClientEvent{client, EVENT_MSG, string(msg)}
+		client.Unlock()
+		buf = append(buf, buf_net[:n]...)
+		for {
+			i := bytes.Index(buf, []byte(CRLF))
+			if i == -1 {
+				break
+			}
+			msg := buf[:i]
+			buf = buf[i+len(CRLF):]
+			if len(msg) > MAX_LINE-len(CRLF) {
+				// Nickname is owned by the daemon, so it is not used
+				client.ReplyParts("417", "*", "Input line was too long")
+				if !client.truncate_long {
+					continue
+				}
+				msg = msg[:MAX_LINE-len(CRLF)]
+			}
+			if len(msg) == 0 {
+				continue
+			}
+			if client.charset == nil {
+				client.EventSend(sink, ClientEvent{client, EVENT_MSG, string(msg)})
+			} else {
+				client.EventSend(sink, ClientEvent{client, EVENT_MSG, client.charset.Decode(msg)})
 			}
 		}
-		buf = []byte{}
+		if len(buf) > BUF_SIZE {
+			log.Println(client.conn.RemoteAddr(), "too long incomplete message")
+			client.Msg("ERROR :Input line was too long")
+			client.conn.Close()
+			client.EventSend(sink, ClientEvent{client, EVENT_DEL, ""})
+			break
+		}
 	}
 }
 
-// Send message as is with CRLF appended.
+// Send message as is with CRLF appended, encoded to client's charset.
+// While labeled command is processed, message is captured instead as a
+// reply to it.
 func (client *Client) Msg(text string) {
-	client.conn.Write([]byte(text + CRLF))
+	client.Lock()
+	if client.label != "" {
+		client.labeled = append(client.labeled, text)
+		client.Unlock()
+		return
+	}
+	client.Unlock()
+	if client.charset == nil {
+		client.conn.Write([]byte(text + CRLF))
+	} else {
+		client.conn.Write(client.charset.Encode(text + CRLF))
+	}
+}
+
+// Prepend IRCv3 tag to message, merging it with message's own tags
+func TagAdd(tag, text string) string {
+	if strings.HasPrefix(text, "@") {
+		return "@" + tag + ";" + text[1:]
+	}
+	return "@" + tag + " " + text
+}
+
+// Start capturing replies to client's command labeled with label
+func (client *Client) LabelStart(label string) {
+	client.Lock()
+	client.label = label
+	client.labeled = nil
+	client.Unlock()
+}
+
+// Stop capturing replies and send them tagged with the label: single
+// reply as is, several ones in labeled-response batch, if client is
+// capable of batches, or ACK if there were no replies at all.
+func (client *Client) LabelEnd() {
+	client.Lock()
+	label, labeled := client.label, client.labeled
+	client.label, client.labeled = "", nil
+	client.Unlock()
+	switch {
+	case len(labeled) == 0:
+		client.Msg(TagAdd("label="+label, ":"+client.hostname+" ACK"))
+	case len(labeled) == 1:
+		client.Msg(TagAdd("label="+label, labeled[0]))
+	case client.caps["batch"]:
+		client.batches++
+		batch := strconv.Itoa(client.batches)
+		client.Msg(TagAdd("label="+label, ":"+client.hostname+" BATCH +"+batch+" labeled-response"))
+		for _, text := range labeled {
+			client.Msg(TagAdd("batch="+batch, text))
+		}
+		client.Reply("BATCH -" + batch)
+	default:
+		for _, text := range labeled {
+			client.Msg(text)
+		}
+	}
 }
 
 // Send message from server. It has ": servername" prefix.
@@ -108,6 +426,13 @@ func (client *Client) ReplyNicknamed(code string, text ...string) {
 	client.ReplyParts(code, append([]string{client.nickname}, text...)...)
 }
 
+// Send IRCv3 standard reply of FAIL, WARN or NOTE kind about command
+// with machine readable code, optional context parameters and human
+// readable description as the last text part.
+func (client *Client) StandardReply(kind, command, code string, text ...string) {
+	client.ReplyParts(kind, append([]string{command, code}, text...)...)
+}
+
 // Reply "461 not enough parameters" error for given command.
 func (client *Client) ReplyNotEnoughParameters(command string) {
 	client.ReplyNicknamed("461", command, "Not enough parameters")
@@ -19,16 +19,23 @@ package main
 
 import (
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 // Testing network connection that satisfies net.Conn interface
 // Can send predefined messages and store all written ones
+// Inbound messages are terminated with CRLF, unless raw is set.
+// Remote address is "someclient", unless addr is set
 type TestingConn struct {
+	sync.Mutex
 	inbound  chan string
 	outbound chan string
 	closed   bool
+	raw      bool
+	addr     net.Addr
 }
 
 func NewTestingConn() *TestingConn {
@@ -37,7 +44,7 @@ func NewTestingConn() *TestingConn {
 	return &TestingConn{inbound: inbound, outbound: outbound}
 }
 
-func (conn TestingConn) Error() string {
+func (conn *TestingConn) Error() string {
 	return "i am finished"
 }
 
@@ -46,10 +53,10 @@ func (conn *TestingConn) Read(b []byte) (n int, err error) {
 	if msg == "" {
 		return 0, conn
 	}
-	for n, bt := range []byte(msg + CRLF) {
-		b[n] = bt
+	if !conn.raw {
+		msg += CRLF
 	}
-	return len(msg), nil
+	return copy(b, msg), nil
 }
 
 type MyAddr struct{}
@@ -67,27 +74,47 @@ func (conn *TestingConn) Write(b []byte) (n int, err error) {
 }
 
 func (conn *TestingConn) Close() error {
+	conn.Lock()
 	conn.closed = true
+	conn.Unlock()
 	return nil
 }
 
-func (conn TestingConn) LocalAddr() net.Addr {
+// Is connection closed. As closing is asynchronous, it waits for it
+// for a while.
+func (conn *TestingConn) Closed() bool {
+	for i := 0; i < 100; i++ {
+		conn.Lock()
+		closed := conn.closed
+		conn.Unlock()
+		if closed {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (conn *TestingConn) LocalAddr() net.Addr {
 	return nil
 }
 
-func (conn TestingConn) RemoteAddr() net.Addr {
+func (conn *TestingConn) RemoteAddr() net.Addr {
+	if conn.addr != nil {
+		return conn.addr
+	}
 	return MyAddr{}
 }
 
-func (conn TestingConn) SetDeadline(t time.Time) error {
+func (conn *TestingConn) SetDeadline(t time.Time) error {
 	return nil
 }
 
-func (conn TestingConn) SetReadDeadline(t time.Time) error {
+func (conn *TestingConn) SetReadDeadline(t time.Time) error {
 	return nil
 }
 
-func (conn TestingConn) SetWriteDeadline(t time.Time) error {
+func (conn *TestingConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
@@ -150,3 +177,128 @@ func TestClientReplies(t *testing.T) {
 		t.Fatal("did not recieve 461 message", r)
 	}
 }
+
+// Messages split between several reads must be reassembled
+func TestPartialLines(t *testing.T) {
+	conn := NewTestingConn()
+	conn.raw = true
+	sink := make(chan ClientEvent)
+	client := NewClient("foohost", conn)
+	go client.Processor(sink)
+	<-sink
+
+	conn.inbound <- "NICK a\r\nUSER "
+	if event := <-sink; (event.event_type != EVENT_MSG) || (event.text != "NICK a") {
+		t.Fatal("first complete message", event)
+	}
+	conn.inbound <- "foo bar baz :Long"
+	conn.inbound <- " name\r\n\r\nPING"
+	if event := <-sink; (event.event_type != EVENT_MSG) || (event.text != "USER foo bar baz :Long name") {
+		t.Fatal("reassembled message", event)
+	}
+	conn.inbound <- " foo\r\n"
+	if event := <-sink; (event.event_type != EVENT_MSG) || (event.text != "PING foo") {
+		t.Fatal("last message", event)
+	}
+	conn.inbound <- ""
+	if event := <-sink; event.event_type != EVENT_DEL {
+		t.Fatal("no client termination", event)
+	}
+}
+
+// Too long messages are either dropped or truncated with 417 reply
+func TestLongLines(t *testing.T) {
+	conn := NewTestingConn()
+	sink := make(chan ClientEvent)
+	client := NewClient("foohost", conn)
+	go client.Processor(sink)
+	<-sink
+
+	long := "PRIVMSG #foo :" + strings.Repeat("x", 600)
+	conn.inbound <- long + "\r\nPING foo"
+	if r := <-conn.outbound; r != ":foohost 417 * :Input line was too long\r\n" {
+		t.Fatal("417 for dropped message", r)
+	}
+	if event := <-sink; event.text != "PING foo" {
+		t.Fatal("too long message is not dropped", event)
+	}
+
+	client.truncate_long = true
+	conn.inbound <- long
+	if r := <-conn.outbound; r != ":foohost 417 * :Input line was too long\r\n" {
+		t.Fatal("417 for truncated message", r)
+	}
+	if event := <-sink; event.text != long[:MAX_LINE-2] {
+		t.Fatal("too long message is not truncated", event)
+	}
+	conn.inbound <- ""
+	<-sink
+}
+
+// Endless message without CRLF must not grow the buffer unboundedly
+func TestEndlessLine(t *testing.T) {
+	conn := NewTestingConn()
+	conn.raw = true
+	sink := make(chan ClientEvent)
+	client := NewClient("foohost", conn)
+	go client.Processor(sink)
+	<-sink
+
+	chunk := strings.Repeat("x", 1000)
+	for i := 0; i < 5; i++ {
+		conn.inbound <- chunk
+	}
+	if event := <-sink; event.event_type != EVENT_DEL {
+		t.Fatal("no client termination", event)
+	}
+	if r := <-conn.outbound; r != "ERROR :Input line was too long\r\n" {
+		t.Fatal("ERROR for too long line", r)
+	}
+	if !conn.Closed() {
+		t.Fatal("connection is not closed")
+	}
+}
+
+// 417 reply must not race with nickname setting by the daemon
+func TestLongLineNickRace(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+
+	conn.inbound <- "NICK abc\r\n" + strings.Repeat("x", 600)
+	if r := <-conn.outbound; r != ":foohost 417 * :Input line was too long\r\n" {
+		t.Fatal("417 after NICK", r)
+	}
+}
+
+func TestClientCharset(t *testing.T) {
+	if c, found := CharsetLookup("UTF-8"); !found || c != nil {
+		t.Fatal("UTF-8 charset lookup")
+	}
+	if c, found := CharsetLookup("windows-1251"); !found || c != CP1251 {
+		t.Fatal("CP1251 charset lookup")
+	}
+	if _, found := CharsetLookup("koi8-u"); found {
+		t.Fatal("unknown charset lookup")
+	}
+
+	conn := NewTestingConn()
+	sink := make(chan ClientEvent)
+	client := NewClient("foohost", conn)
+	client.charset = CP1251
+	go client.Processor(sink)
+	<-sink
+
+	// "привет, Ёж" in CP1251
+	conn.inbound <- "PRIVMSG #foo :\xef\xf0\xe8\xe2\xe5\xf2, \xa8\xe6"
+	if event := <-sink; event.text != "PRIVMSG #foo :привет, Ёж" {
+		t.Fatal("decoded CP1251 message", event.text)
+	}
+	client.Msg("мир — ☺")
+	if r := <-conn.outbound; r != "\xec\xe8\xf0 \x97 ?\r\n" {
+		t.Fatalf("encoded CP1251 message %q", r)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximal time of single write to client's connection
+	WRITE_TIMEOUT = 30 * time.Second
+	// Default maximal number of bytes queued for sending to client
+	SENDQ = 1 << 20
+)
+
+// Client's connection with outbound queue. Writes only queue data, that
+// is sent to the underlying connection by separate writer goroutine, so
+// stalled client can not block daemon's and rooms processors. Connection
+// is dropped when queued data exceeds sendq bytes, or when single write
+// does not complete in WRITE_TIMEOUT. Close takes effect after already
+// queued data is sent.
+type QueuedConn struct {
+	net.Conn
+	sync.Mutex
+	queue   [][]byte
+	queued  int
+	sendq   int
+	closing bool
+	ready   chan struct{}
+}
+
+func NewQueuedConn(conn net.Conn) *QueuedConn {
+	qc := QueuedConn{Conn: conn, sendq: SENDQ}
+	qc.ready = make(chan struct{}, 1)
+	go qc.Writer()
+	return &qc
+}
+
+// Wake up writer goroutine, if it is not already woken up
+func (conn *QueuedConn) wake() {
+	select {
+	case conn.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (conn *QueuedConn) Write(b []byte) (int, error) {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.closing {
+		return 0, io.ErrClosedPipe
+	}
+	if conn.queued+len(b) > conn.sendq {
+		log.Println(conn.RemoteAddr(), "sendq exceeded")
+		conn.closing = true
+		conn.queue = nil
+		conn.Conn.Close()
+		conn.wake()
+		return 0, io.ErrClosedPipe
+	}
+	conn.queue = append(conn.queue, append([]byte{}, b...))
+	conn.queued += len(b)
+	conn.wake()
+	return len(b), nil
+}
+
+// Change maximal number of bytes queued for sending
+func (conn *QueuedConn) SendqSet(sendq int) {
+	conn.Lock()
+	conn.sendq = sendq
+	conn.Unlock()
+}
+
+func (conn *QueuedConn) Close() error {
+	conn.Lock()
+	conn.closing = true
+	conn.Unlock()
+	conn.wake()
+	return nil
+}
+
+// Writer sends queued data to the underlying connection, each write
+// limited with WRITE_TIMEOUT, and closes it when requested or failed.
+func (conn *QueuedConn) Writer() {
+	for range conn.ready {
+		conn.Lock()
+		queue, closing := conn.queue, conn.closing
+		conn.queue = nil
+		conn.Unlock()
+		for _, b := range queue {
+			conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			if _, err := conn.Conn.Write(b); err != nil {
+				log.Println(conn.RemoteAddr(), "write failed", err)
+				conn.Lock()
+				conn.closing = true
+				conn.Unlock()
+				closing = true
+				break
+			}
+			conn.Lock()
+			conn.queued -= len(b)
+			conn.Unlock()
+		}
+		if closing {
+			conn.Conn.Close()
+			return
+		}
+	}
+}
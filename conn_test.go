@@ -0,0 +1,66 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+)
+
+func TestQueuedConn(t *testing.T) {
+	conn := NewTestingConn()
+	qc := NewQueuedConn(conn)
+	qc.Write([]byte("foo"))
+	qc.Write([]byte("bar"))
+	if r := <-conn.outbound; r != "foo" {
+		t.Fatal("first queued write", r)
+	}
+	if r := <-conn.outbound; r != "bar" {
+		t.Fatal("second queued write", r)
+	}
+	qc.Write([]byte("baz"))
+	qc.Close()
+	if _, err := qc.Write([]byte("qux")); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+	if r := <-conn.outbound; r != "baz" {
+		t.Fatal("queued data is not sent before closing", r)
+	}
+	if !conn.Closed() {
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestQueuedConnSendq(t *testing.T) {
+	conn := NewTestingConn()
+	// Unbuffered outbound stalls writer until test reads from it
+	conn.outbound = make(chan string)
+	qc := NewQueuedConn(conn)
+	qc.SendqSet(10)
+	if _, err := qc.Write([]byte("12345")); err != nil {
+		t.Fatal("write within sendq failed", err)
+	}
+	if _, err := qc.Write([]byte("123456")); err == nil {
+		t.Fatal("write exceeding sendq succeeded")
+	}
+	if !conn.Closed() {
+		t.Fatal("connection exceeding sendq is not closed")
+	}
+	if _, err := qc.Write([]byte("1")); err == nil {
+		t.Fatal("write after exceeding sendq succeeded")
+	}
+}
@@ -18,114 +18,976 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
+	VERSION = "goircd-0.1"
+
 	PING_TIMEOUT    = time.Second * 180 // Max time deadline for client's unresponsiveness
 	PING_THRESHOLD  = time.Second * 90  // Max idle client's time before PING are sent
 	ALIVENESS_CHECK = time.Second * 10  // Client's aliveness check period
+	TLS_HANDSHAKE   = time.Second * 10  // Max time TLS handshake may take
+	REG_TIMEOUT     = time.Second * 30  // Default deadline for registration completion
+
+	CHANCREATE_WINDOW = time.Minute // Period of channels creation rate limit
+	AUTO_AWAY_MESSAGE = "Auto away: idle"
+
+	NICKNAME_LEN = 9  // Default max nickname length
+	USERNAME_LEN = 16 // Longer usernames are truncated
+
+	SASL_CHUNK    = 400  // AUTHENTICATE payload chunk length
+	SASL_LEN      = 2000 // Max length of reassembled AUTHENTICATE payload
+	SASL_FAILURES = 3    // Failed SASL attempts before disconnection
 )
 
 var (
-	RE_NICKNAME = regexp.MustCompile("^[a-zA-Z0-9-]{1,9}$")
+	// Letters, digits and RFC 2812 special characters. "*" is never
+	// allowed, as it denotes unregistered client.
+	RE_NICKNAME = regexp.MustCompile("^[a-zA-Z0-9\\[\\]\\\\`_^{}|-]+$")
 )
 
+// Daemon's clients, nicknames, rooms and room_sinks maps are accessed only from
+// its Processor goroutine: command handlers must be called directly,
+// not in separate goroutines. Rooms states are owned by their own
+// processors, so daemon reads them holding room's RLock.
 type Daemon struct {
 	Verbose              bool
+	OperOnlyChancreate   bool
+	BadNicks             []string
+	BadChans             []string
+	AwayWindow           time.Duration
+	Opers                map[string]string
+	OpersFile            string
+	Accounts             map[string]string
+	AccountsFile         string
+	AccountService       AccountService
+	DefaultUmodes        string
+	AutoAway             time.Duration
+	RegTimeout           time.Duration
+	MaxUnregistered      int
+	ReserveNicks         bool
+	ResumeWindow         time.Duration
+	CtcpVersion          string
+	CtcpSource           string
+	ListBatch            int
+	FloodRate            float64
+	FloodBurst           int
+	ChancreateRate       int
+	MaxChannels          int
+	MaxMessage           int
+	AuditSink            chan<- AuditEvent
+	Network              string
+	NicknameLen          int
+	AdminName            string
+	AdminLoc             string
+	AdminEmail           string
 	hostname             string
 	motd                 string
+	motd_lines           []string
 	clients              map[*Client]bool
+	unregistered         int
+	guests               int
+	nicknames            map[string]*Client
+	resumable            map[string]*Client
+	listings             map[*Client][]string
 	rooms                map[string]*Room
 	room_sinks           map[*Room]chan ClientEvent
+	rooms_wg             sync.WaitGroup
 	last_aliveness_check time.Time
+	started              time.Time
+	commands             map[string]int
 	log_sink             chan<- LogEvent
 	state_sink           chan<- StateEvent
+	// Client whose labeled command is being processed
+	labeled *Client
+}
+
+// Case insensitive glob matching: "*" matches any sequence of
+// characters and "?" matches any single one
+func GlobMatch(pattern, s string) bool {
+	return globMatch([]rune(strings.ToLower(pattern)), []rune(strings.ToLower(s)))
+}
+
+// Iterative matching, backtracking only to the most recent "*", so it
+// takes O(len(p)*len(r)) time at most
+func globMatch(p, r []rune) bool {
+	pi, ri := 0, 0
+	star, mark := -1, 0
+	for ri < len(r) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == r[ri]):
+			pi++
+			ri++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ri
+			pi++
+		case star != -1:
+			mark++
+			pi, ri = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// Does name match any of the forbidding patterns
+func NameForbidden(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if GlobMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read credentials file consisting of "name:sha256hexdigest" lines.
+// Empty lines and ones beginning with "#" are skipped.
+func ReadCredentials(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cols := strings.SplitN(line, ":", 2)
+		if len(cols) != 2 || cols[0] == "" || len(cols[1]) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s:%d: invalid credentials line", filename, n+1)
+		}
+		credentials[cols[0]] = strings.ToLower(cols[1])
+	}
+	return credentials, nil
+}
+
+// Connection class: limits applied to clients connecting from network.
+// Zero limit means no limit or default value.
+type ConnClass struct {
+	network      *net.IPNet
+	max_per_ip   int
+	ping_timeout time.Duration
+	sendq        int
+}
+
+// Read connection classes file consisting of "cidr max-per-ip
+// ping-timeout sendq" lines, like "10.0.0.0/8 20 10m 65536". Empty lines
+// and ones beginning with "#" are skipped. Non-zero ping timeout must
+// exceed PING_THRESHOLD, as PONG is awaited for their difference.
+func ReadConnClasses(filename string) ([]*ConnClass, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	classes := []*ConnClass{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cols := strings.Fields(line)
+		if len(cols) != 4 {
+			return nil, fmt.Errorf("%s:%d: invalid connection class line", filename, n+1)
+		}
+		class := ConnClass{}
+		if _, class.network, err = net.ParseCIDR(cols[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, n+1, err)
+		}
+		if class.max_per_ip, err = strconv.Atoi(cols[1]); err != nil || class.max_per_ip < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid max-per-ip", filename, n+1)
+		}
+		if class.ping_timeout, err = time.ParseDuration(cols[2]); err != nil || class.ping_timeout < 0 ||
+			(class.ping_timeout > 0 && class.ping_timeout <= PING_THRESHOLD) {
+			return nil, fmt.Errorf("%s:%d: invalid ping-timeout", filename, n+1)
+		}
+		if class.sendq, err = strconv.Atoi(cols[3]); err != nil || class.sendq < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid sendq", filename, n+1)
+		}
+		classes = append(classes, &class)
+	}
+	return classes, nil
+}
+
+// Find the first connection class containing address, if any
+func ConnClassLookup(classes []*ConnClass, addr net.Addr) *ConnClass {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, class := range classes {
+		if class.network.Contains(ip) {
+			return class
+		}
+	}
+	return nil
+}
+
+// Virtual host: certificate and network name presented to TLS clients
+// requesting server name via SNI
+type VHost struct {
+	server_name string
+	network     string
+	cert        tls.Certificate
+}
+
+// Read virtual hosts file consisting of "server-name cert-file key-file
+// network" lines. Empty lines and ones beginning with "#" are skipped.
+func ReadVHosts(filename string) ([]*VHost, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	vhosts := []*VHost{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cols := strings.Fields(line)
+		if len(cols) != 4 {
+			return nil, fmt.Errorf("%s:%d: invalid virtual host line", filename, n+1)
+		}
+		vhost := VHost{server_name: strings.ToLower(cols[0]), network: cols[3]}
+		if vhost.cert, err = tls.LoadX509KeyPair(cols[1], cols[2]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, n+1, err)
+		}
+		vhosts = append(vhosts, &vhost)
+	}
+	return vhosts, nil
+}
+
+// Find virtual host by server name, case insensitively
+func VHostLookup(vhosts []*VHost, server_name string) *VHost {
+	server_name = strings.ToLower(server_name)
+	for _, vhost := range vhosts {
+		if vhost.server_name == server_name {
+			return vhost
+		}
+	}
+	return nil
+}
+
+// TLS configuration presenting virtual hosts certificates to clients
+// requesting them with SNI, and default certificate to everyone else
+func VHostsTLSConfig(vhosts []*VHost, cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if vhost := VHostLookup(vhosts, hello.ServerName); vhost != nil {
+				return &vhost.cert, nil
+			}
+			return &cert, nil
+		},
+	}
+}
+
+// Complete TLS handshake and find virtual host requested by client.
+// Failed handshake is left for client's processor to notice.
+func VHostHandshake(conn *tls.Conn, vhosts []*VHost) *VHost {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return nil
+	}
+	return VHostLookup(vhosts, conn.ConnectionState().ServerName)
+}
+
+// Per source IP connection rate limiter: no more than limit connects
+// are allowed during sliding window. It is shared by all listeners.
+type ConnLimiter struct {
+	sync.Mutex
+	limit      int
+	window     time.Duration
+	connects   map[string][]time.Time
+	last_prune time.Time
+}
+
+func NewConnLimiter(limit int, window time.Duration) *ConnLimiter {
+	return &ConnLimiter{limit: limit, window: window, connects: make(map[string][]time.Time)}
+}
+
+// Register connect from address at specified time, telling if it is
+// allowed. Rejected connects are not counted. Addresses without recent
+// connects are forgotten once per window.
+func (limiter *ConnLimiter) Allow(addr net.Addr, now time.Time) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	since := now.Add(-limiter.window)
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.last_prune.Before(since) {
+		for h, connects := range limiter.connects {
+			if !connects[len(connects)-1].After(since) {
+				delete(limiter.connects, h)
+			}
+		}
+		limiter.last_prune = now
+	}
+	connects := limiter.connects[host]
+	for len(connects) > 0 && !connects[0].After(since) {
+		connects = connects[1:]
+	}
+	if len(connects) >= limiter.limit {
+		limiter.connects[host] = connects
+		return false
+	}
+	limiter.connects[host] = append(connects, now)
+	return true
+}
+
+// Check password against credentials read by ReadCredentials
+func CredentialsValid(credentials map[string]string, name, password string) bool {
+	hash, found := credentials[name]
+	if !found {
+		return false
+	}
+	digest := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest[:])), []byte(hash)) == 1
+}
+
+// Nicknames to accounts mapping and accounts authentication service.
+// Embedders may plug their own one into Daemon.AccountService, otherwise
+// FileAccounts with Daemon.Accounts credentials is used.
+type AccountService interface {
+	// Account reserving nickname, or empty string if there is none
+	Lookup(nickname string) string
+	// Check account's password
+	Authenticate(account, password string) bool
+	// Is nickname allowed to be used by client identified as account
+	Owns(account, nickname string) bool
+}
+
+// Accounts credentials read by ReadCredentials. Each account reserves
+// nickname equal to its name, case insensitively.
+type FileAccounts map[string]string
+
+func (accounts FileAccounts) Lookup(nickname string) string {
+	for account := range accounts {
+		if strings.EqualFold(account, nickname) {
+			return account
+		}
+	}
+	return ""
+}
+
+func (accounts FileAccounts) Authenticate(account, password string) bool {
+	return CredentialsValid(accounts, account, password)
+}
+
+func (accounts FileAccounts) Owns(account, nickname string) bool {
+	_, found := accounts[account]
+	return found && strings.EqualFold(account, nickname)
 }
 
 func NewDaemon(hostname, motd string, log_sink chan<- LogEvent, state_sink chan<- StateEvent) *Daemon {
-	daemon := Daemon{hostname: hostname, motd: motd}
+	daemon := Daemon{hostname: hostname, motd: motd, Network: hostname, NicknameLen: NICKNAME_LEN}
 	daemon.clients = make(map[*Client]bool)
+	daemon.nicknames = make(map[string]*Client)
+	daemon.resumable = make(map[string]*Client)
+	daemon.listings = make(map[*Client][]string)
+	daemon.started = time.Now()
+	daemon.commands = make(map[string]int)
 	daemon.rooms = make(map[string]*Room)
 	daemon.room_sinks = make(map[*Room]chan ClientEvent)
 	daemon.log_sink = log_sink
 	daemon.state_sink = state_sink
+	daemon.MotdLoad()
 	return &daemon
 }
 
+// Is nickname valid and not longer than NicknameLen
+func (daemon *Daemon) NicknameValid(nickname string) bool {
+	return len(nickname) <= daemon.NicknameLen && RE_NICKNAME.MatchString(nickname)
+}
+
+// Find registered client by his nickname, case insensitively
+func (daemon *Daemon) ClientByNickname(nickname string) *Client {
+	c, found := daemon.nicknames[strings.ToLower(nickname)]
+	if !found || !c.registered {
+		return nil
+	}
+	return c
+}
+
+// Forget about disconnected client: remove it from clients list,
+// nicknames index and other clients away notification timestamps
+func (daemon *Daemon) ClientForget(client *Client) {
+	if _, found := daemon.clients[client]; !found {
+		return
+	}
+	delete(daemon.clients, client)
+	delete(daemon.listings, client)
+	if !client.registered {
+		daemon.unregistered--
+	}
+	nickname := strings.ToLower(client.nickname)
+	if daemon.nicknames[nickname] == client {
+		delete(daemon.nicknames, nickname)
+	}
+	for c := range daemon.clients {
+		delete(c.away_sent, client)
+	}
+}
+
+// Tokens advertised in 005 reply
+func (daemon *Daemon) ISupport() []string {
+	tokens := []string{
+		"CHANTYPES=#",
+		"CHANMODES=be,k,,Rmnps",
+		"PREFIX=(" + PREFIX_MODES + ")" + PREFIX_SYMBOLS,
+		"NICKLEN=" + strconv.Itoa(daemon.NicknameLen),
+		"CHANNELLEN=" + strconv.Itoa(len("#")+ROOM_NAME_LEN),
+		"NAMESX",
+		"UHNAMES",
+	}
+	if daemon.Network != "" {
+		tokens = append(tokens, "NETWORK="+daemon.Network)
+	}
+	return tokens
+}
+
+// Check advertised ISUPPORT tokens against actually implemented
+// features. Returns found problems descriptions.
+func (daemon *Daemon) validateISupport() []string {
+	return daemon.ISupportProblems(daemon.ISupport())
+}
+
+// Check ISUPPORT tokens against implemented channel types, channel
+// modes, members statuses prefixes and capabilities. Unknown tokens are
+// reported too, as they can not be checked.
+func (daemon *Daemon) ISupportProblems(tokens []string) []string {
+	problems := []string{}
+	advertised := ""
+	for _, token := range tokens {
+		kv := strings.SplitN(token, "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch kv[0] {
+		case "CHANTYPES":
+			for _, c := range value {
+				if !RoomNameValid(string(c) + "room") {
+					problems = append(problems, "CHANTYPES: unsupported channel type "+string(c))
+				}
+			}
+		case "CHANMODES":
+			groups := strings.Split(value, ",")
+			if len(groups) != 4 {
+				problems = append(problems, "CHANMODES: four groups of modes expected")
+			}
+			advertised += strings.Join(groups, "")
+		case "PREFIX":
+			i := strings.Index(value, ")")
+			if !strings.HasPrefix(value, "(") || i == -1 || i-1 != len(value)-i-1 {
+				problems = append(problems, "PREFIX: malformed "+value)
+				continue
+			}
+			modes, symbols := value[1:i], value[i+1:]
+			advertised += modes
+			if modes != PREFIX_MODES || symbols != PREFIX_SYMBOLS {
+				problems = append(problems, "PREFIX: "+value+" differs from implemented ("+PREFIX_MODES+")"+PREFIX_SYMBOLS)
+			}
+		case "NICKLEN":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || !daemon.NicknameValid(strings.Repeat("a", n)) ||
+				daemon.NicknameValid(strings.Repeat("a", n+1)) {
+				problems = append(problems, "NICKLEN: nicknames are not limited to "+value)
+			}
+		case "CHANNELLEN":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 2 || !RoomNameValid("#"+strings.Repeat("a", n-1)) ||
+				RoomNameValid("#"+strings.Repeat("a", n)) {
+				problems = append(problems, "CHANNELLEN: channels names are not limited to "+value)
+			}
+		case "NETWORK":
+			if value == "" || strings.ContainsAny(value, " ,") {
+				problems = append(problems, "NETWORK: invalid network name "+value)
+			}
+		case "NAMESX":
+			if !CapabilitySupported("multi-prefix") {
+				problems = append(problems, "NAMESX: multi-prefix capability is not supported")
+			}
+		case "UHNAMES":
+			if !CapabilitySupported("userhost-in-names") {
+				problems = append(problems, "UHNAMES: userhost-in-names capability is not supported")
+			}
+		default:
+			problems = append(problems, "unknown token "+token)
+		}
+	}
+	for _, mode := range advertised {
+		if !strings.ContainsRune(CHANNEL_MODES, mode) {
+			problems = append(problems, "channel mode "+string(mode)+" is advertised, but not implemented")
+		}
+	}
+	for _, mode := range CHANNEL_MODES {
+		if !strings.ContainsRune(advertised, mode) {
+			problems = append(problems, "channel mode "+string(mode)+" is implemented, but not advertised")
+		}
+	}
+	return problems
+}
+
+// Stop rooms processors, waiting for them to handle already sent
+// events, disconnect all clients and save all rooms states. State sink
+// is closed after that, so StateKeeper finishes after writing them.
+func (daemon *Daemon) Shutdown() {
+	for _, room_sink := range daemon.room_sinks {
+		close(room_sink)
+	}
+	daemon.rooms_wg.Wait()
+	for c := range daemon.clients {
+		c.Msg("ERROR :Server shutting down")
+		c.conn.Close()
+	}
+	for room := range daemon.room_sinks {
+		room.StateSave()
+	}
+	close(daemon.state_sink)
+}
+
+// Lock all rooms, so their processors can not read clients being
+// changed by the daemon
+func (daemon *Daemon) RoomsLock() {
+	for room := range daemon.room_sinks {
+		room.Lock()
+	}
+}
+
+func (daemon *Daemon) RoomsUnlock() {
+	for room := range daemon.room_sinks {
+		room.Unlock()
+	}
+}
+
+// Change client's nickname, notifying him and members of all his rooms.
+// Rooms are locked during the change, as they read their members
+// nicknames.
+func (daemon *Daemon) ClientNickChange(client *Client, nickname string) {
+	msg := fmt.Sprintf(":%s NICK :%s", client.Hostmask(), nickname)
+	notified := map[*Client]bool{client: true}
+	daemon.RoomsLock()
+	for room := range daemon.room_sinks {
+		if _, subscribed := room.members[client]; !subscribed {
+			continue
+		}
+		for member := range room.members {
+			notified[member] = true
+		}
+		daemon.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), "changed nickname to " + nickname, true}
+	}
+	log.Println(client, "changed nickname to", nickname)
+	delete(daemon.nicknames, strings.ToLower(client.nickname))
+	daemon.nicknames[strings.ToLower(nickname)] = client
+	client.nickname = nickname
+	daemon.RoomsUnlock()
+	for c := range notified {
+		c.Msg(msg)
+	}
+}
+
 func (daemon *Daemon) SendLusers(client *Client) {
 	lusers := 0
+	invisible := 0
 	for client := range daemon.clients {
-		if client.registered {
+		if !client.registered {
+			continue
+		}
+		if client.invisible {
+			invisible++
+		} else {
 			lusers++
 		}
 	}
-	client.ReplyNicknamed("251", fmt.Sprintf("There are %d users and 0 invisible on 1 servers", lusers))
+	client.ReplyNicknamed("251", fmt.Sprintf("There are %d users and %d invisible on 1 servers", lusers, invisible))
 }
 
-func (daemon *Daemon) SendMotd(client *Client) {
+// Reread configuration files: MOTD, OpersFile and AccountsFile
+// credentials. Credentials are left intact if their file is invalid.
+// Connections and rooms are not affected.
+func (daemon *Daemon) Rehash() error {
+	daemon.MotdLoad()
+	if daemon.OpersFile != "" {
+		credentials, err := ReadCredentials(daemon.OpersFile)
+		if err != nil {
+			return fmt.Errorf("can not read opers file: %v", err)
+		}
+		daemon.Opers = credentials
+	}
+	if daemon.AccountsFile != "" {
+		credentials, err := ReadCredentials(daemon.AccountsFile)
+		if err != nil {
+			return fmt.Errorf("can not read accounts file: %v", err)
+		}
+		daemon.Accounts = credentials
+	}
+	return nil
+}
+
+// Read MOTD file into the cache SendMotd serves from. Failed reading
+// leaves MOTD empty.
+func (daemon *Daemon) MotdLoad() {
+	daemon.motd_lines = nil
 	if len(daemon.motd) == 0 {
-		client.ReplyNicknamed("422", "MOTD File is missing")
 		return
 	}
-
 	motd, err := ioutil.ReadFile(daemon.motd)
 	if err != nil {
 		log.Printf("Can not read motd file %s: %v", daemon.motd, err)
+		return
+	}
+	text := strings.TrimRight(strings.Replace(string(motd), "\r\n", "\n", -1), "\n")
+	daemon.motd_lines = strings.Split(text, "\n")
+}
+
+func (daemon *Daemon) SendMotd(client *Client) {
+	if len(daemon.motd) == 0 {
+		client.ReplyNicknamed("422", "MOTD File is missing")
+		return
+	}
+	if daemon.motd_lines == nil {
 		client.ReplyNicknamed("422", "Error reading MOTD File")
 		return
 	}
 
 	client.ReplyNicknamed("375", "- "+daemon.hostname+" Message of the day -")
-	for _, s := range strings.Split(strings.Trim(string(motd), "\n"), "\n") {
-		client.ReplyNicknamed("372", "- "+string(s))
+	for _, line := range daemon.motd_lines {
+		client.ReplyNicknamed("372", "- "+line)
 	}
 	client.ReplyNicknamed("376", "End of /MOTD command")
 }
 
+func (daemon *Daemon) SendAdmin(client *Client) {
+	if daemon.AdminName == "" && daemon.AdminLoc == "" && daemon.AdminEmail == "" {
+		client.ReplyNicknamed("423", daemon.hostname, "No administrative info available")
+		return
+	}
+	client.ReplyNicknamed("256", daemon.hostname, "Administrative info")
+	client.ReplyNicknamed("257", daemon.AdminLoc)
+	client.ReplyNicknamed("258", daemon.AdminName)
+	client.ReplyNicknamed("259", daemon.AdminEmail)
+}
+
+func (daemon *Daemon) SendStats(client *Client, query string) {
+	switch query {
+	case "m":
+		commands := []string{}
+		for command := range daemon.commands {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		for _, command := range commands {
+			client.ReplyNicknamed("212", command, strconv.Itoa(daemon.commands[command]))
+		}
+	case "u":
+		uptime := time.Since(daemon.started)
+		client.ReplyNicknamed("242", fmt.Sprintf(
+			"Server Up %d days %d:%02d:%02d",
+			int(uptime.Hours())/24,
+			int(uptime.Hours())%24,
+			int(uptime.Minutes())%60,
+			int(uptime.Seconds())%60,
+		))
+	}
+	client.ReplyNicknamed("219", query, "End of STATS report")
+}
+
+func (daemon *Daemon) SendInfo(client *Client) {
+	for _, line := range []string{
+		VERSION + " -- minimalistic simple Internet Relay Chat (IRC) server",
+		"Copyright (C) 2014 Sergey Matveev <stargrave@stargrave.org>",
+		"Licensed under GNU General Public License version 3 or later",
+	} {
+		client.ReplyNicknamed("371", line)
+	}
+	client.ReplyNicknamed("374", "End of /INFO list")
+}
+
 func (daemon *Daemon) SendWhois(client *Client, nicknames []string) {
 	for _, nickname := range nicknames {
-		nickname = strings.ToLower(nickname)
-		found := false
-		for c := range daemon.clients {
-			if strings.ToLower(c.nickname) != nickname {
-				continue
+		c := daemon.ClientByNickname(nickname)
+		if c == nil {
+			client.ReplyNoNickChan(strings.ToLower(nickname))
+			continue
+		}
+		client.ReplyNicknamed("311", c.nickname, c.username, c.Host(), "*", c.realname)
+		client.ReplyNicknamed("312", c.nickname, daemon.hostname, daemon.hostname)
+		if c.operator {
+			client.ReplyNicknamed("313", c.nickname, "is an IRC operator")
+		}
+		if c.away != "" {
+			client.ReplyNicknamed("301", c.nickname, c.away)
+		}
+		if !c.idlehidden || client.operator {
+			idle := int(time.Since(c.last_activity).Seconds())
+			client.ReplyNicknamed("317", c.nickname, strconv.Itoa(idle), strconv.FormatInt(c.signon.Unix(), 10), "seconds idle, signon time")
+		}
+		if c.account != "" {
+			client.ReplyNicknamed("330", c.nickname, c.account, "is logged in as")
+		}
+		subscriptions := []string{}
+		for _, room := range daemon.rooms {
+			room.RLock()
+			_, subscribed := room.members[c]
+			_, member := room.members[client]
+			if subscribed && (!room.secret || member) {
+				subscriptions = append(subscriptions, room.name)
 			}
-			found = true
-			h := c.conn.RemoteAddr().String()
-			h, _, err := net.SplitHostPort(h)
-			if err != nil {
-				log.Printf("Can't parse RemoteAddr %q: %v", h, err)
-				h = "Unknown"
-			}
-			client.ReplyNicknamed("311", c.nickname, c.username, h, "*", c.realname)
-			client.ReplyNicknamed("312", c.nickname, daemon.hostname, daemon.hostname)
-			subscriptions := []string{}
-			for _, room := range daemon.rooms {
-				for subscriber := range room.members {
-					if subscriber.nickname == nickname {
-						subscriptions = append(subscriptions, room.name)
-					}
-				}
+			room.RUnlock()
+		}
+		sort.Strings(subscriptions)
+		client.ReplyNicknamed("319", c.nickname, strings.Join(subscriptions, " "))
+		client.ReplyNicknamed("318", c.nickname, "End of /WHOIS list")
+	}
+}
+
+// Members of the rooms client is subscribed to, including itself
+func (daemon *Daemon) ClientNeighbours(client *Client) map[*Client]bool {
+	neighbours := map[*Client]bool{client: true}
+	for room := range daemon.room_sinks {
+		room.RLock()
+		if _, subscribed := room.members[client]; subscribed {
+			for member := range room.members {
+				neighbours[member] = true
 			}
-			sort.Strings(subscriptions)
-			client.ReplyNicknamed("319", c.nickname, strings.Join(subscriptions, " "))
-			client.ReplyNicknamed("318", c.nickname, "End of /WHOIS list")
 		}
-		if !found {
-			client.ReplyNoNickChan(nickname)
+		room.RUnlock()
+	}
+	return neighbours
+}
+
+// Reply SASL authentication failure. Client is disconnected after
+// SASL_FAILURES of them.
+func (daemon *Daemon) SaslFail(client *Client) {
+	client.ReplyNicknamed("904", "SASL authentication failed")
+	client.sasl_failures++
+	if client.sasl_failures >= SASL_FAILURES {
+		log.Println(client, "too many SASL authentication failures")
+		client.Msg("ERROR :Too many SASL authentication failures")
+		client.conn.Close()
+	}
+}
+
+// Announce client's quit with the reason to all its neighbours once
+// and remove it from all rooms. Client is marked as quitted first, so
+// rooms ignore its JOINs still being processed: either it has already
+// joined and is seen as neighbour, or it will never join.
+func (daemon *Daemon) ClientQuit(client *Client, reason string) {
+	daemon.RoomsLock()
+	client.quitted = true
+	daemon.RoomsUnlock()
+	msg := fmt.Sprintf(":%s QUIT :%s", client.Hostmask(), reason)
+	for c := range daemon.ClientNeighbours(client) {
+		if c != client {
+			c.Msg(msg)
+		}
+	}
+	for _, room_sink := range daemon.room_sinks {
+		room_sink <- ClientEvent{client, EVENT_QUIT, reason}
+	}
+}
+
+// SASL authentication during registration. Only PLAIN mechanism is
+// supported, with credentials checked against daemon's Accounts.
+// Payload is sent in SASL_CHUNK long chunks: shorter one, or "+" if
+// payload's length is multiple of SASL_CHUNK, ends it.
+func (daemon *Daemon) HandlerAuthenticate(client *Client, cols []string) {
+	if !client.caps["sasl"] {
+		return
+	}
+	if len(cols) == 1 || len(cols[1]) < 1 {
+		client.ReplyNotEnoughParameters("AUTHENTICATE")
+		return
+	}
+	if client.account != "" {
+		client.ReplyNicknamed("907", "You have already authenticated using SASL")
+		return
+	}
+	arg := strings.Fields(cols[1])[0]
+	if arg == "*" {
+		client.sasl_mechanism = ""
+		client.sasl_payload = ""
+		client.ReplyNicknamed("906", "SASL authentication aborted")
+		return
+	}
+	if client.sasl_mechanism == "" {
+		if strings.ToUpper(arg) != "PLAIN" {
+			client.ReplyNicknamed("908", "PLAIN", "are available SASL mechanisms")
+			daemon.SaslFail(client)
+			return
+		}
+		client.sasl_mechanism = "PLAIN"
+		client.Msg("AUTHENTICATE +")
+		return
+	}
+	if arg != "+" {
+		client.sasl_payload += arg
+	}
+	if len(arg) > SASL_CHUNK || len(client.sasl_payload) > SASL_LEN {
+		client.sasl_mechanism = ""
+		client.sasl_payload = ""
+		client.ReplyNicknamed("905", "SASL message too long")
+		return
+	}
+	if len(arg) == SASL_CHUNK {
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(client.sasl_payload)
+	client.sasl_mechanism = ""
+	client.sasl_payload = ""
+	if err != nil {
+		daemon.SaslFail(client)
+		return
+	}
+	parts := strings.Split(string(payload), "\x00")
+	if len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) ||
+		!daemon.AccountsService().Authenticate(parts[1], parts[2]) {
+		log.Println(client, "SASL authentication failed")
+		daemon.SaslFail(client)
+		return
+	}
+	client.account = parts[1]
+	log.Println(client, "authenticated as", client.account)
+	client.ReplyNicknamed("900", client.Hostmask(), client.account, "You are now logged in as "+client.account)
+	client.ReplyNicknamed("903", "SASL authentication successful")
+}
+
+// Change client's realname and notify setname capable members of the
+// rooms it is subscribed to, including itself
+func (daemon *Daemon) HandlerSetname(client *Client, realname string) {
+	daemon.RoomsLock()
+	client.realname = realname
+	daemon.RoomsUnlock()
+	msg := fmt.Sprintf(":%s SETNAME :%s", client.Hostmask(), realname)
+	for c := range daemon.ClientNeighbours(client) {
+		if c.caps["setname"] {
+			c.Msg(msg)
 		}
 	}
 }
 
+// Set client's away message, or unset it if message is empty, and
+// notify away-notify capable members of the rooms it is subscribed to
+func (daemon *Daemon) ClientAway(client *Client, message string) {
+	daemon.RoomsLock()
+	client.away = message
+	daemon.RoomsUnlock()
+	client.away_auto = false
+	msg := fmt.Sprintf(":%s AWAY", client.Hostmask())
+	if message != "" {
+		msg += " :" + message
+	}
+	for c := range daemon.ClientNeighbours(client) {
+		if c != client && c.caps["away-notify"] {
+			c.Msg(msg)
+		}
+	}
+}
+
+// Send "301 away" reply about target to client, but not more often than
+// once per AwayWindow for the same target.
+func (daemon *Daemon) SendAway(client, target *Client) {
+	now := time.Now()
+	if sent, found := client.away_sent[target]; found && sent.Add(daemon.AwayWindow).After(now) {
+		return
+	}
+	client.away_sent[target] = now
+	client.ReplyNicknamed("301", target.nickname, target.away)
+}
+
+func (daemon *Daemon) SendIson(client *Client, nicknames []string) {
+	online := []string{}
+	for _, nickname := range nicknames {
+		if c := daemon.ClientByNickname(nickname); c != nil {
+			online = append(online, c.nickname)
+		}
+	}
+	client.ReplyNicknamed("303", strings.Join(online, " "))
+}
+
+func (daemon *Daemon) SendUserhost(client *Client, nicknames []string) {
+	if len(nicknames) > 5 {
+		nicknames = nicknames[:5]
+	}
+	replies := []string{}
+	for _, nickname := range nicknames {
+		c := daemon.ClientByNickname(nickname)
+		if c == nil {
+			continue
+		}
+		reply := c.nickname
+		if c.operator {
+			reply += "*"
+		}
+		if c.away == "" {
+			reply += "=+"
+		} else {
+			reply += "=-"
+		}
+		replies = append(replies, reply+c.username+"@"+c.Host())
+	}
+	client.ReplyNicknamed("302", strings.Join(replies, " "))
+}
+
+// Send WHO reply about registered clients with nickname or host
+// matching the mask. Invisible ones are shown only to their neighbours.
+func (daemon *Daemon) SendWhoMask(client *Client, mask string) {
+	neighbours := daemon.ClientNeighbours(client)
+	nicknames := []string{}
+	for nickname, c := range daemon.nicknames {
+		if !c.registered || (c.invisible && !neighbours[c]) {
+			continue
+		}
+		if GlobMatch(mask, c.nickname) || GlobMatch(mask, c.Host()) {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	sort.Strings(nicknames)
+	for _, nickname := range nicknames {
+		c := daemon.nicknames[nickname]
+		client.ReplyNicknamed("352", "*", c.username, c.Host(), daemon.hostname, c.nickname, c.WhoStatus(), "0 "+c.realname)
+	}
+	client.ReplyNicknamed("315", mask, "End of /WHO list")
+}
+
+// Send LIST reply. With non-zero ListBatch, it is sent by batches of
+// that many rooms interleaved with other events processing. Client has
+// to wait for its previous LIST reply completion.
 func (daemon *Daemon) SendList(client *Client, cols []string) {
+	if _, listing := daemon.listings[client]; listing {
+		client.ReplyNicknamed("263", "LIST", "Please wait a while and try again.")
+		return
+	}
 	var rooms []string
 	if (len(cols) > 1) && (cols[1] != "") {
 		rooms = strings.Split(strings.Split(cols[1], " ")[0], ",")
@@ -136,77 +998,489 @@ func (daemon *Daemon) SendList(client *Client, cols []string) {
 		}
 	}
 	sort.Strings(rooms)
-	for _, room := range rooms {
-		r, found := daemon.rooms[room]
-		if found {
-			client.ReplyNicknamed("322", room, fmt.Sprintf("%d", len(r.members)), r.topic)
+	if daemon.ListBatch == 0 {
+		for _, room := range rooms {
+			if r, found := daemon.RoomByName(room); found {
+				daemon.SendListEntry(client, r)
+			}
+		}
+		client.ReplyNicknamed("323", "End of /LIST")
+		return
+	}
+	daemon.listings[client] = rooms
+	daemon.ListingsProceed()
+}
+
+// Send next ListBatch rooms of every pending LIST reply, finishing the
+// ones with no rooms left. Processor calls it between events, so huge
+// listings do not starve other clients.
+func (daemon *Daemon) ListingsProceed() {
+	for client, rooms := range daemon.listings {
+		n := daemon.ListBatch
+		if n > len(rooms) {
+			n = len(rooms)
 		}
+		for _, room := range rooms[:n] {
+			if r, found := daemon.RoomByName(room); found {
+				daemon.SendListEntry(client, r)
+			}
+		}
+		if n == len(rooms) {
+			delete(daemon.listings, client)
+			client.ReplyNicknamed("323", "End of /LIST")
+			continue
+		}
+		daemon.listings[client] = rooms[n:]
+	}
+}
+
+// Send LIST entry about the room to client. Secret rooms are listed
+// and private rooms topics are shown only to their members.
+func (daemon *Daemon) SendListEntry(client *Client, r *Room) {
+	r.RLock()
+	defer r.RUnlock()
+	member := client.RoomMember(r)
+	if r.secret && !member {
+		return
+	}
+	topic := r.topic
+	if r.private && !member {
+		topic = ""
+	}
+	client.ReplyNicknamed("322", r.name, fmt.Sprintf("%d", len(r.members)), topic)
+}
+
+// Is capability listed in CAPABILITIES
+func CapabilitySupported(name string) bool {
+	for _, c := range strings.Fields(CAPABILITIES) {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IRCv3 capabilities negotiation: LS lists supported capabilities, LIST
+// enabled ones, REQ enables (or disables, if prefixed with "-")
+// requested ones. Request is either acknowledged or rejected entirely.
+// LS and REQ sent before registration suspend it until END.
+func (daemon *Daemon) HandlerCap(client *Client, cols []string) {
+	if len(cols) == 1 || len(cols[1]) < 1 {
+		client.ReplyNotEnoughParameters("CAP")
+		return
+	}
+	args := strings.SplitN(cols[1], " ", 2)
+	subcommand := strings.ToUpper(args[0])
+	switch subcommand {
+	case "LS":
+		client.cap_negotiating = !client.registered
+		client.Reply(fmt.Sprintf("CAP %s LS :%s", client.nickname, CAPABILITIES))
+	case "LIST":
+		enabled := []string{}
+		for name := range client.caps {
+			enabled = append(enabled, name)
+		}
+		sort.Strings(enabled)
+		client.Reply(fmt.Sprintf("CAP %s LIST :%s", client.nickname, strings.Join(enabled, " ")))
+	case "REQ":
+		if len(args) == 1 {
+			client.ReplyNotEnoughParameters("CAP")
+			return
+		}
+		client.cap_negotiating = !client.registered
+		requested := strings.TrimLeft(args[1], ":")
+		for _, name := range strings.Fields(requested) {
+			if !CapabilitySupported(strings.TrimPrefix(name, "-")) {
+				client.Reply(fmt.Sprintf("CAP %s NAK :%s", client.nickname, requested))
+				return
+			}
+		}
+		daemon.RoomsLock()
+		for _, name := range strings.Fields(requested) {
+			if strings.HasPrefix(name, "-") {
+				delete(client.caps, name[1:])
+			} else {
+				client.caps[name] = true
+			}
+		}
+		daemon.RoomsUnlock()
+		client.Reply(fmt.Sprintf("CAP %s ACK :%s", client.nickname, requested))
+	case "END":
+		client.cap_negotiating = false
+	default:
+		client.ReplyNicknamed("410", args[0], "Invalid CAP command")
+	}
+}
+
+// Split message into its IRCv3 tags, if any, and the rest of it
+func TagsSplit(text string) ([]string, string) {
+	if !strings.HasPrefix(text, "@") {
+		return nil, text
+	}
+	cols := strings.SplitN(text, " ", 2)
+	if len(cols) == 1 {
+		return strings.Split(cols[0][1:], ";"), ""
+	}
+	return strings.Split(cols[0][1:], ";"), strings.TrimLeft(cols[1], " ")
+}
+
+// Value of the tag with specified key, or empty string if it is absent
+func TagValue(tags []string, key string) string {
+	for _, tag := range tags {
+		cols := strings.SplitN(tag, "=", 2)
+		if cols[0] == key && len(cols) == 2 {
+			return cols[1]
+		}
+	}
+	return ""
+}
+
+// Relay client-only tags (prefixed with "+") to message-tags capable
+// target client or room members. TAGMSG without them is dropped.
+func (daemon *Daemon) HandlerTagmsg(client *Client, target string, tags []string) {
+	relayed := []string{}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "+") {
+			relayed = append(relayed, tag)
+		}
+	}
+	if len(relayed) == 0 {
+		return
+	}
+	target = strings.ToLower(target)
+	for c := range daemon.clients {
+		if c.nickname == target {
+			if c.caps["message-tags"] {
+				c.Msg(fmt.Sprintf("@%s :%s TAGMSG %s", strings.Join(relayed, ";"), client.Hostmask(), c.nickname))
+			}
+			return
+		}
+	}
+	r, found := daemon.rooms[target]
+	if !found {
+		client.ReplyNoNickChan(target)
+		return
+	}
+	daemon.room_sinks[r] <- ClientEvent{client, EVENT_MSG, "TAGMSG " + strings.Join(relayed, ";")}
+}
+
+// Send replies to labeled command processed last, if any
+func (daemon *Daemon) LabelEnd() {
+	if daemon.labeled != nil {
+		daemon.labeled.LabelEnd()
+		daemon.labeled = nil
+	}
+}
+
+// Unregistered client workflow processor. Unregistered client:
+// * is not PINGed
+// * only QUIT, CAP, AUTHENTICATE, PASS, NICK and USER commands are processed
+// * other commands are quietly ignored
+// When client finishes NICK/USER workflow and CAP negotiation, if it was
+// started, then MOTD and LUSERS are send to him.
+func (daemon *Daemon) ClientRegister(client *Client, command string, cols []string) {
+	switch command {
+	case "CAP":
+		daemon.HandlerCap(client, cols)
+	case "AUTHENTICATE":
+		daemon.HandlerAuthenticate(client, cols)
+	case "RESUME":
+		daemon.ClientResume(client, cols)
+		return
+	case "NICK":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyParts("431", "No nickname given")
+			return
+		}
+		nickname := cols[1]
+		if c, found := daemon.nicknames[strings.ToLower(nickname)]; found && c != client {
+			client.ReplyParts("433", "*", nickname, "Nickname is already in use")
+			return
+		}
+		if !daemon.NicknameValid(nickname) || NameForbidden(nickname, daemon.BadNicks) {
+			client.ReplyParts("432", "*", cols[1], "Erroneous nickname")
+			return
+		}
+		daemon.ClientNickSet(client, nickname)
+	case "PASS":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("PASS")
+			return
+		}
+		client.password = strings.TrimLeft(cols[1], ":")
+	case "USER":
+		if len(cols) == 1 {
+			client.ReplyNotEnoughParameters("USER")
+			return
+		}
+		args := strings.SplitN(cols[1], " ", 4)
+		if len(args) < 4 {
+			client.ReplyNotEnoughParameters("USER")
+			return
+		}
+		client.username = args[0]
+		if len(client.username) > USERNAME_LEN {
+			client.username = client.username[:USERNAME_LEN]
+		}
+		client.realname = strings.TrimLeft(args[3], ":")
+	}
+	if client.nickname != "*" && client.username != "" && !client.cap_negotiating {
+		if daemon.ReserveNicks {
+			daemon.ClientNickCheck(client)
+		}
+		client.password = ""
+		client.registered = true
+		daemon.unregistered--
+		client.last_activity = time.Now()
+		client.signon = client.last_activity
+		daemon.SendWelcome(client)
+		if applied, _ := client.ModesApply(daemon.DefaultUmodes); applied != "" {
+			client.Msg(fmt.Sprintf(":%s MODE %s :%s", client.Hostmask(), client.nickname, applied))
+		}
+		daemon.ResumeTokenIssue(client)
+	}
+}
+
+// Send registration completion burst: welcome, LUSERS and MOTD replies
+func (daemon *Daemon) SendWelcome(client *Client) {
+	client.ReplyNicknamed("001", "Hi, welcome to IRC")
+	client.ReplyNicknamed("002", "Your host is "+daemon.hostname+", running "+VERSION)
+	client.ReplyNicknamed("003", "This server was created sometime")
+	client.ReplyNicknamed("004", daemon.hostname+" "+VERSION+" "+USER_MODES+" "+CHANNEL_MODES)
+	isupport := daemon.ISupport()
+	for i, token := range isupport {
+		if strings.HasPrefix(token, "NETWORK=") && client.network != "" {
+			isupport[i] = "NETWORK=" + client.network
+		}
+	}
+	client.ReplyNicknamed("005", append(isupport, "are supported by this server")...)
+	daemon.SendLusers(client)
+	daemon.SendMotd(client)
+}
+
+// Issue new resume token to draft/resume capable client, if sessions
+// retaining is enabled.
+func (daemon *Daemon) ResumeTokenIssue(client *Client) {
+	if daemon.ResumeWindow == 0 || !client.caps["draft/resume"] {
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Println("Can not generate resume token", err)
+		return
+	}
+	client.resume_token = hex.EncodeToString(buf)
+	client.Reply("RESUME TOKEN " + client.resume_token)
+}
+
+// Resume detached client's session with the token. Unregistered client
+// takes over its nickname, modes and channels membership, so other
+// clients do not see neither quit, nor join.
+func (daemon *Daemon) ClientResume(client *Client, cols []string) {
+	if !client.caps["draft/resume"] {
+		return
+	}
+	if len(cols) == 1 {
+		client.ReplyNotEnoughParameters("RESUME")
+		return
+	}
+	token := strings.TrimLeft(strings.Fields(cols[1])[0], ":")
+	old, found := daemon.resumable[token]
+	if !found {
+		client.Reply("RESUME ERR :Cannot resume connection, token is invalid")
+		return
+	}
+	delete(daemon.resumable, token)
+	daemon.ClientForget(old)
+	rooms := []*Room{}
+	daemon.RoomsLock()
+	daemon.ClientNickSet(client, old.nickname)
+	client.username = old.username
+	client.realname = old.realname
+	client.away = old.away
+	client.away_auto = old.away_auto
+	client.operator = old.operator
+	client.invisible = old.invisible
+	client.wallops = old.wallops
+	client.account = old.account
+	client.signon = old.signon
+	for _, room := range daemon.rooms {
+		if room.MemberReplace(old, client) {
+			client.rooms[room] = true
+			rooms = append(rooms, room)
+		}
+	}
+	daemon.RoomsUnlock()
+	log.Println(client, "resumed session")
+	client.password = ""
+	client.registered = true
+	daemon.unregistered--
+	client.last_activity = time.Now()
+	client.Reply("RESUME SUCCESS " + client.nickname)
+	daemon.SendWelcome(client)
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+	for _, room := range rooms {
+		room.RLock()
+		client.Msg(":" + client.Hostmask() + " JOIN " + room.name)
+		room.SendTopic(client)
+		room.SendNames(client)
+		room.RUnlock()
+	}
+	daemon.ResumeTokenIssue(client)
+}
+
+// Set unregistered client's nickname, updating nicknames index
+func (daemon *Daemon) ClientNickSet(client *Client, nickname string) {
+	if daemon.nicknames[strings.ToLower(client.nickname)] == client {
+		delete(daemon.nicknames, strings.ToLower(client.nickname))
+	}
+	daemon.nicknames[strings.ToLower(nickname)] = client
+	client.nickname = nickname
+}
+
+// Accounts service in use: either plugged one, or file based default
+func (daemon *Daemon) AccountsService() AccountService {
+	if daemon.AccountService != nil {
+		return daemon.AccountService
+	}
+	return FileAccounts(daemon.Accounts)
+}
+
+// Is client identified to the account owning its current nickname
+func (daemon *Daemon) ClientIdentified(client *Client) bool {
+	return client.account != "" && daemon.AccountsService().Owns(client.account, client.nickname)
+}
+
+// Check that client registering with nickname reserved by an account
+// has authenticated to it either with SASL or PASS. Otherwise it is
+// renamed to guest nickname.
+func (daemon *Daemon) ClientNickCheck(client *Client) {
+	accounts := daemon.AccountsService()
+	account := accounts.Lookup(client.nickname)
+	if account == "" || daemon.ClientIdentified(client) {
+		return
+	}
+	if client.account == "" && accounts.Authenticate(account, client.password) {
+		client.account = account
+		log.Println(client, "authenticated as", account)
+		return
 	}
-	client.ReplyNicknamed("323", "End of /LIST")
+	nickname := daemon.GuestNickname()
+	log.Println(client, "is not authenticated for reserved nickname, renamed to", nickname)
+	client.ReplyParts("433", "*", client.nickname, "Nickname is reserved, you are renamed to "+nickname)
+	daemon.ClientNickSet(client, nickname)
 }
 
-// Unregistered client workflow processor. Unregistered client:
-// * is not PINGed
-// * only QUIT, NICK and USER commands are processed
-// * other commands are quietly ignored
-// When client finishes NICK/USER workflow, then MOTD and LUSERS are send to him.
-func (daemon *Daemon) ClientRegister(client *Client, command string, cols []string) {
-	switch command {
-	case "NICK":
-		if len(cols) == 1 || len(cols[1]) < 1 {
-			client.ReplyParts("431", "No nickname given")
-			return
-		}
-		nickname := cols[1]
-		for client := range daemon.clients {
-			if client.nickname == nickname {
-				client.ReplyParts("433", "*", nickname, "Nickname is already in use")
-				return
-			}
-		}
-		if !RE_NICKNAME.MatchString(nickname) {
-			client.ReplyParts("432", "*", cols[1], "Erroneous nickname")
-			return
+// Free guest nickname: "Guest" followed by the counter of guests. The
+// prefix is shortened to fit NicknameLen, when the counter grows long.
+func (daemon *Daemon) GuestNickname() string {
+	for {
+		daemon.guests++
+		n := strconv.Itoa(daemon.guests)
+		if len(n) > daemon.NicknameLen {
+			daemon.guests = 0
+			continue
 		}
-		client.nickname = nickname
-	case "USER":
-		if len(cols) == 1 {
-			client.ReplyNotEnoughParameters("USER")
-			return
+		prefix := "Guest"
+		if len(prefix)+len(n) > daemon.NicknameLen {
+			prefix = prefix[:daemon.NicknameLen-len(n)]
 		}
-		args := strings.SplitN(cols[1], " ", 4)
-		if len(args) < 4 {
-			client.ReplyNotEnoughParameters("USER")
-			return
+		nickname := prefix + n
+		if _, found := daemon.nicknames[strings.ToLower(nickname)]; !found {
+			return nickname
 		}
-		client.username = args[0]
-		client.realname = strings.TrimLeft(args[3], ":")
-	}
-	if client.nickname != "*" && client.username != "" {
-		client.registered = true
-		client.ReplyNicknamed("001", "Hi, welcome to IRC")
-		client.ReplyNicknamed("002", "Your host is "+daemon.hostname+", running goircd")
-		client.ReplyNicknamed("003", "This server was created sometime")
-		client.ReplyNicknamed("004", daemon.hostname+" goircd o o")
-		daemon.SendLusers(client)
-		daemon.SendMotd(client)
 	}
 }
 
+// Key of the room in daemon's rooms index: sanitized names are case
+// insensitive
+func RoomKey(name string) string {
+	name, _ = RoomNameSanitize(name)
+	return strings.ToLower(name)
+}
+
+// Find room by its case insensitive name
+func (daemon *Daemon) RoomByName(name string) (*Room, bool) {
+	room, found := daemon.rooms[RoomKey(name)]
+	return room, found
+}
+
 // Register new room in Daemon. Create an object, events sink, save pointers
 // to corresponding daemon's places and start room's processor goroutine.
 func (daemon *Daemon) RoomRegister(name string) (*Room, chan<- ClientEvent) {
 	room_new := NewRoom(daemon.hostname, name, daemon.log_sink, daemon.state_sink)
 	room_new.Verbose = daemon.Verbose
+	room_new.MaxMessage = daemon.MaxMessage
+	room_new.audit_sink = daemon.AuditSink
 	room_sink := make(chan ClientEvent)
-	daemon.rooms[name] = room_new
+	daemon.rooms[RoomKey(name)] = room_new
 	daemon.room_sinks[room_new] = room_sink
-	go room_new.Processor(room_sink)
+	daemon.rooms_wg.Add(1)
+	go func() {
+		room_new.Processor(room_sink)
+		daemon.rooms_wg.Done()
+	}()
 	return room_new, room_sink
 }
 
+// Load rooms states saved by StateKeeper in statedir and register
+// corresponding rooms. Unreadable and corrupted states are logged and
+// skipped.
+func (daemon *Daemon) StatesLoad(statedir string) error {
+	states, err := filepath.Glob(path.Join(statedir, "#*"))
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		name := path.Base(state)
+		buf, err := ioutil.ReadFile(state)
+		if err != nil {
+			log.Printf("Can not read state %s: %v", state, err)
+			continue
+		}
+		record, err := StateParse(buf)
+		if !RoomNameValid(name) || err != nil {
+			log.Printf("State corrupted for %s: %v", name, err)
+			continue
+		}
+		room, _ := daemon.RoomRegister(name)
+		room.Lock()
+		room.topic = record.Topic
+		room.key = record.Key
+		room.bans = record.Bans
+		room.excepts = record.Excepts
+		room.op_accounts = record.OpAccounts
+		if record.TopicBy != "" {
+			room.topic_by = record.TopicBy
+			room.topic_time = time.Unix(record.TopicTime, 0)
+		}
+		if record.Created != 0 {
+			room.created = time.Unix(record.Created, 0)
+		}
+		room.Unlock()
+		log.Println("Loaded state for room", room.name)
+	}
+	return nil
+}
+
+// Join client to rooms, creating absent ones. It must be called from
+// daemon's processor only, as it owns rooms index: that serializes
+// simultaneous creation of the same room.
 func (daemon *Daemon) HandlerJoin(client *Client, cmd string) {
 	args := strings.Split(cmd, " ")
+	if args[0] == "0" {
+		// Leave all rooms
+		for room, room_sink := range daemon.room_sinks {
+			room.RLock()
+			_, subscribed := room.members[client]
+			room.RUnlock()
+			if subscribed {
+				delete(client.rooms, room)
+				room_sink <- ClientEvent{client, EVENT_DEL, ""}
+			}
+		}
+		return
+	}
 	rooms := strings.Split(args[0], ",")
 	var keys []string
 	if len(args) > 1 {
@@ -215,122 +1489,510 @@ func (daemon *Daemon) HandlerJoin(client *Client, cmd string) {
 		keys = []string{}
 	}
 	for n, room := range rooms {
-		if !RoomNameValid(room) {
+		room, valid := RoomNameSanitize(room)
+		if !valid {
 			client.ReplyNoChannel(room)
 			continue
 		}
+		if !client.operator && NameForbidden(room, daemon.BadChans) {
+			client.ReplyNicknamed("479", room, "Illegal channel name")
+			continue
+		}
 		var key string
 		if (n < len(keys)) && (keys[n] != "") {
 			key = keys[n]
 		} else {
 			key = ""
 		}
-		denied := false
-		joined := false
-		for room_existing, room_sink := range daemon.room_sinks {
-			if room == room_existing.name {
-				if (room_existing.key != "") && (room_existing.key != key) {
-					denied = true
-				} else {
-					room_sink <- ClientEvent{client, EVENT_NEW, ""}
-					joined = true
-				}
-				break
+		room_existing, found := daemon.RoomByName(room)
+		if daemon.MaxChannels > 0 && len(client.rooms) >= daemon.MaxChannels &&
+			!(found && client.rooms[room_existing]) {
+			client.ReplyNicknamed("405", room, "You have joined too many channels")
+			continue
+		}
+		if found {
+			room_existing.RLock()
+			banned := room_existing.Banned(client)
+			denied := (room_existing.key != "") && (room_existing.key != key)
+			regonly := room_existing.regonly
+			room_existing.RUnlock()
+			if banned {
+				client.ReplyNicknamed("474", room, "Cannot join channel (+b)")
+			} else if regonly && !daemon.ClientIdentified(client) {
+				client.ReplyNicknamed("477", room, "Cannot join channel (+R) - you need to be identified")
+			} else if denied {
+				client.ReplyNicknamed("475", room, "Cannot join channel (+k) - bad key")
+			} else {
+				client.rooms[room_existing] = true
+				daemon.room_sinks[room_existing] <- ClientEvent{client, EVENT_NEW, ""}
 			}
+			continue
+		}
+		if daemon.OperOnlyChancreate && !client.operator {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			continue
 		}
-		if denied {
-			client.ReplyNicknamed("475", room, "Cannot join channel (+k) - bad key")
+		if daemon.ChancreateRate > 0 && !client.operator && !client.ChancreateCheck(daemon.ChancreateRate, time.Now()) {
+			if client.caps["standard-replies"] {
+				client.StandardReply("FAIL", "JOIN", "LIMIT_EXCEEDED", room, "Too many channels created, try again later")
+			} else {
+				client.ReplyNicknamed("480", room, "Cannot create channel (throttled), try again later")
+			}
+			continue
 		}
-		if denied || joined {
+		if key != "" && !KeyValid(key) {
+			client.ReplyNicknamed("525", room, "Key is not well-formed")
 			continue
 		}
 		room_new, room_sink := daemon.RoomRegister(room)
 		if key != "" {
+			room_new.Lock()
 			room_new.key = key
 			room_new.StateSave()
+			room_new.Unlock()
 		}
+		client.rooms[room_new] = true
 		room_sink <- ClientEvent{client, EVENT_NEW, ""}
 	}
 }
 
+// Deliver PRIVMSG or NOTICE text to single target: either client,
+// room, server itself or broadcast mask
+func (daemon *Daemon) HandlerMsg(client *Client, command, target, text string) {
+	if strings.HasPrefix(target, "$") {
+		if !client.operator {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		daemon.HandlerBroadcast(client, target[1:], text)
+		return
+	}
+	if target == strings.ToLower(daemon.hostname) {
+		if command == "PRIVMSG" {
+			daemon.HandlerCtcp(client, text)
+		}
+		return
+	}
+	if c := daemon.ClientByNickname(target); c != nil {
+		c.Msg(fmt.Sprintf(":%s %s %s :%s", client.Hostmask(), command, c.nickname, text))
+		if daemon.AuditSink != nil {
+			daemon.AuditSink <- NewAuditEvent(command, client.Hostmask(), c.Hostmask(), text)
+		}
+		if command == "PRIVMSG" && c.away != "" {
+			daemon.SendAway(client, c)
+		}
+		return
+	}
+	r, found := daemon.RoomByName(target)
+	if !found {
+		if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&") {
+			client.ReplyNoChannel(target)
+		} else {
+			client.ReplyNoNickChan(target)
+		}
+		return
+	}
+	daemon.room_sinks[r] <- ClientEvent{client, EVENT_MSG, command + " " + text}
+}
+
+// Rename room, moving all its members, modes and state to the new name
+func (daemon *Daemon) HandlerRename(client *Client, name, name_new, reason string) {
+	r, found := daemon.RoomByName(name)
+	if !found {
+		client.ReplyNoChannel(name)
+		return
+	}
+	name_new, valid := RoomNameSanitize(name_new)
+	if !valid {
+		if client.caps["standard-replies"] {
+			client.StandardReply("FAIL", "RENAME", "CANNOT_RENAME", name, name_new, "Invalid channel name")
+		} else {
+			client.ReplyNoChannel(name_new)
+		}
+		return
+	}
+	if r_existing, found := daemon.RoomByName(name_new); found && r_existing != r {
+		if client.caps["standard-replies"] {
+			client.StandardReply("FAIL", "RENAME", "CHANNEL_NAME_IN_USE", name, name_new, "Channel name is already in use")
+		} else {
+			client.ReplyNicknamed("437", name_new, "Channel name is already in use")
+		}
+		return
+	}
+	delete(daemon.rooms, RoomKey(name))
+	daemon.rooms[RoomKey(name_new)] = r
+	daemon.room_sinks[r] <- ClientEvent{client, EVENT_RENAME, name_new + " " + reason}
+}
+
+// Reject CHATHISTORY requests with standard replies, as messages
+// history is not kept
+func (daemon *Daemon) HandlerChathistory(client *Client, cols []string) {
+	if len(cols) == 1 || len(cols[1]) < 1 {
+		client.StandardReply("FAIL", "CHATHISTORY", "NEED_MORE_PARAMS", "Missing parameters")
+		return
+	}
+	subcommand := strings.ToUpper(strings.Fields(cols[1])[0])
+	switch subcommand {
+	case "LATEST", "BEFORE", "AFTER", "AROUND", "BETWEEN", "TARGETS":
+		client.StandardReply("FAIL", "CHATHISTORY", "MESSAGE_ERROR", subcommand, "Messages history is not kept")
+	default:
+		client.StandardReply("FAIL", "CHATHISTORY", "INVALID_PARAMS", subcommand, "Unknown subcommand")
+	}
+}
+
+// Answer CTCP query sent to the server itself. VERSION reply is
+// CtcpVersion, or VERSION by default, SOURCE one is CtcpSource, if set.
+// Other queries and plain messages are ignored.
+func (daemon *Daemon) HandlerCtcp(client *Client, text string) {
+	if len(text) < 2 || !strings.HasPrefix(text, "\x01") {
+		return
+	}
+	query := strings.ToUpper(strings.Fields(strings.Trim(text, "\x01") + " ")[0])
+	var reply string
+	switch query {
+	case "VERSION":
+		reply = daemon.CtcpVersion
+		if reply == "" {
+			reply = VERSION
+		}
+	case "SOURCE":
+		reply = daemon.CtcpSource
+	}
+	if reply == "" {
+		return
+	}
+	client.Reply(fmt.Sprintf("NOTICE %s :\x01%s %s\x01", client.nickname, query, reply))
+}
+
+// Forcibly change other client's nickname
+func (daemon *Daemon) HandlerSanick(client *Client, nickname, nickname_new string) {
+	target := daemon.ClientByNickname(nickname)
+	if target == nil {
+		client.ReplyNoNickChan(nickname)
+		return
+	}
+	if !daemon.NicknameValid(nickname_new) {
+		client.ReplyNicknamed("432", nickname_new, "Erroneous nickname")
+		return
+	}
+	if c := daemon.ClientByNickname(nickname_new); c != nil && c != target {
+		client.ReplyNicknamed("433", nickname_new, "Nickname is already in use")
+		return
+	}
+	daemon.ClientNickChange(target, nickname_new)
+}
+
+// Send server NOTICE to every registered client, if server's hostname
+// matches mask, like "*"
+func (daemon *Daemon) HandlerBroadcast(client *Client, mask, text string) {
+	if !GlobMatch(mask, daemon.hostname) {
+		client.ReplyNicknamed("402", "$"+mask, "No such server")
+		return
+	}
+	log.Println(client, "broadcasted", text)
+	for c := range daemon.clients {
+		if c.registered {
+			c.Reply(fmt.Sprintf("NOTICE %s :%s", c.nickname, text))
+		}
+	}
+}
+
+// Forcibly disconnect client with specified nickname, notifying him
+// and all the rooms about it
+func (daemon *Daemon) HandlerKill(client *Client, nickname, reason string) {
+	target := daemon.ClientByNickname(nickname)
+	if target == nil {
+		client.ReplyNoNickChan(nickname)
+		return
+	}
+	log.Println(target, "killed by", client, reason)
+	target.Msg(fmt.Sprintf(":%s KILL %s :%s", client.Hostmask(), target.nickname, reason))
+	target.Msg(fmt.Sprintf("ERROR :Closing Link: %s (Killed (%s (%s)))", target.nickname, client.nickname, reason))
+	target.conn.Close()
+	daemon.ClientQuit(target, fmt.Sprintf("Killed (%s (%s))", client.nickname, reason))
+	daemon.ClientForget(target)
+}
+
+// Daemon processor handles clients events one by one. Replies to
+// labeled command are captured while it is processed, so the ones sent
+// asynchronously, like rooms replies, are not labeled.
 func (daemon *Daemon) Processor(events <-chan ClientEvent) {
-	for event := range events {
+	for {
+		daemon.LabelEnd()
+		var event ClientEvent
+		var ok bool
+		if len(daemon.listings) > 0 {
+			select {
+			case event, ok = <-events:
+			default:
+				daemon.ListingsProceed()
+				continue
+			}
+		} else {
+			event, ok = <-events
+		}
+		if !ok {
+			return
+		}
 
 		// Check for clients aliveness
 		now := time.Now()
 		if daemon.last_aliveness_check.Add(ALIVENESS_CHECK).Before(now) {
 			for c := range daemon.clients {
-				if c.timestamp.Add(PING_TIMEOUT).Before(now) {
+				if !c.detached.IsZero() {
+					if c.detached.Add(daemon.ResumeWindow).Before(now) {
+						log.Println(c, "resume window expired")
+						delete(daemon.resumable, c.resume_token)
+						daemon.ClientQuit(c, c.quit_reason)
+						daemon.ClientForget(c)
+					}
+					continue
+				}
+				if daemon.RegTimeout > 0 && !c.registered && c.connected.Add(daemon.RegTimeout).Before(now) {
+					log.Println(c, "registration timeout")
+					c.Msg("ERROR :Registration timeout")
+					c.conn.Close()
+					continue
+				}
+				c.Lock()
+				timestamp := c.timestamp
+				c.Unlock()
+				if timestamp.Add(c.PingTimeout()).Before(now) ||
+					(c.ping_sent && c.ping_time.Add(c.PingTimeout()-PING_THRESHOLD).Before(now)) {
 					log.Println(c, "ping timeout")
+					c.quit_reason = "Ping timeout"
 					c.conn.Close()
 					continue
 				}
-				if !c.ping_sent && c.timestamp.Add(PING_THRESHOLD).Before(now) {
+				if !c.ping_sent && timestamp.Add(PING_THRESHOLD).Before(now) {
 					if c.registered {
-						c.Msg("PING :" + daemon.hostname)
+						c.ping_token = strconv.FormatInt(now.UnixNano(), 36)
 						c.ping_sent = true
+						c.ping_time = now
+						c.Msg("PING :" + c.ping_token)
 					} else {
 						log.Println(c, "ping timeout")
 						c.conn.Close()
 					}
 				}
+				// Event's client activity is processed below
+				if daemon.AutoAway > 0 && c.registered && c.away == "" && c != event.client &&
+					c.last_activity.Add(daemon.AutoAway).Before(now) {
+					daemon.ClientAway(c, AUTO_AWAY_MESSAGE)
+					c.away_auto = true
+					c.ReplyNicknamed("306", "You have been marked as being away")
+				}
 			}
 			daemon.last_aliveness_check = now
 		}
 
 		client := event.client
 		switch event.event_type {
+		case EVENT_SHUTDOWN:
+			daemon.Shutdown()
+			return
+		case EVENT_RELOAD:
+			log.Println("Rehashing on signal")
+			if err := daemon.Rehash(); err != nil {
+				log.Println("Rehash failed", err)
+			}
 		case EVENT_NEW:
+			if daemon.MaxUnregistered > 0 && daemon.unregistered >= daemon.MaxUnregistered {
+				log.Println(client, "too many unregistered connections")
+				client.Msg("ERROR :Too many unregistered connections, try again later")
+				client.conn.Close()
+				continue
+			}
+			if client.class != nil && client.class.max_per_ip > 0 {
+				host := client.Host()
+				connections := 0
+				for c := range daemon.clients {
+					if c.Host() == host {
+						connections++
+					}
+				}
+				if connections >= client.class.max_per_ip {
+					log.Println(client, "too many connections from host")
+					client.Msg("ERROR :Too many connections from your host")
+					client.conn.Close()
+					continue
+				}
+			}
 			daemon.clients[client] = true
+			daemon.unregistered++
 		case EVENT_DEL:
-			delete(daemon.clients, client)
-			for _, room_sink := range daemon.room_sinks {
-				room_sink <- event
+			if _, found := daemon.clients[client]; !found {
+				// Already quitted or killed
+				continue
+			}
+			if client.quit_reason == "" {
+				client.quit_reason = "Connection closed"
 			}
+			if client.registered && client.resume_token != "" {
+				log.Println(client, "detached, session is retained")
+				client.detached = now
+				daemon.resumable[client.resume_token] = client
+				continue
+			}
+			if client.registered {
+				daemon.ClientQuit(client, client.quit_reason)
+			}
+			daemon.ClientForget(client)
 		case EVENT_MSG:
-			cols := strings.SplitN(event.text, " ", 2)
+			if _, found := daemon.clients[client]; !found {
+				// Rejected, killed or quitted client's leftovers
+				continue
+			}
+			if daemon.FloodRate > 0 && !client.operator && !client.FloodCheck(daemon.FloodRate, daemon.FloodBurst, now) {
+				log.Println(client, "excess flood")
+				if client.registered {
+					daemon.ClientQuit(client, "Excess Flood")
+				}
+				daemon.ClientForget(client)
+				client.Msg("ERROR :Excess flood")
+				client.conn.Close()
+				continue
+			}
+			tags, text := TagsSplit(event.text)
+			if text == "" {
+				continue
+			}
+			if label := TagValue(tags, "label"); label != "" && client.caps["labeled-response"] {
+				client.LabelStart(label)
+				daemon.labeled = client
+			}
+			cols := strings.SplitN(text, " ", 2)
 			command := strings.ToUpper(cols[0])
 			if daemon.Verbose {
 				log.Println(client, "command", command)
 			}
 			if command == "QUIT" {
-				delete(daemon.clients, client)
+				if client.registered {
+					reason := "Client Quit"
+					if len(cols) > 1 && strings.TrimLeft(cols[1], ":") != "" {
+						reason = strings.TrimLeft(cols[1], ":")
+					}
+					daemon.ClientQuit(client, reason)
+				}
+				daemon.ClientForget(client)
+				client.Msg("ERROR :Closing Link: " + client.nickname)
 				client.conn.Close()
 				continue
 			}
 			if !client.registered {
-				go daemon.ClientRegister(client, command, cols)
+				daemon.ClientRegister(client, command, cols)
 				continue
 			}
+			if command != "PING" && command != "PONG" {
+				client.last_activity = now
+				if client.away_auto {
+					daemon.ClientAway(client, "")
+					client.ReplyNicknamed("305", "You are no longer marked as being away")
+				}
+			}
+			daemon.commands[command]++
 			switch command {
+			case "ADMIN":
+				daemon.SendAdmin(client)
 			case "AWAY":
-				continue
+				if len(cols) == 1 || strings.TrimLeft(cols[1], ":") == "" {
+					daemon.ClientAway(client, "")
+					client.ReplyNicknamed("305", "You are no longer marked as being away")
+					continue
+				}
+				daemon.ClientAway(client, strings.TrimLeft(cols[1], ":"))
+				client.ReplyNicknamed("306", "You have been marked as being away")
+			case "CAP":
+				daemon.HandlerCap(client, cols)
+			case "CHATHISTORY":
+				if !client.caps["standard-replies"] {
+					delete(daemon.commands, command)
+					client.ReplyNicknamed("421", command, "Unknown command")
+					continue
+				}
+				daemon.HandlerChathistory(client, cols)
+			case "DEBUG":
+				if !client.operator {
+					client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+					continue
+				}
+				args := []string{}
+				if len(cols) > 1 {
+					args = strings.Fields(cols[1])
+				}
+				if len(args) < 2 || strings.ToUpper(args[0]) != "ROOM" {
+					client.ReplyNotEnoughParameters("DEBUG")
+					continue
+				}
+				r, found := daemon.RoomByName(args[1])
+				if !found {
+					client.ReplyNoChannel(args[1])
+					continue
+				}
+				daemon.room_sinks[r] <- ClientEvent{client, EVENT_DEBUG, ""}
+			case "DIE":
+				if !client.operator {
+					client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+					continue
+				}
+				log.Println(client, "requested shutdown")
+				daemon.Shutdown()
+				return
+			case "INFO":
+				daemon.SendInfo(client)
+			case "ISON":
+				if len(cols) == 1 || len(cols[1]) < 1 {
+					client.ReplyNotEnoughParameters("ISON")
+					continue
+				}
+				daemon.SendIson(client, strings.Fields(strings.TrimLeft(cols[1], ":")))
 			case "JOIN":
 				if len(cols) == 1 || len(cols[1]) < 1 {
 					client.ReplyNotEnoughParameters("JOIN")
 					continue
 				}
-				go daemon.HandlerJoin(client, cols[1])
+				daemon.HandlerJoin(client, cols[1])
+			case "KILL":
+				if !client.operator {
+					client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+					continue
+				}
+				if len(cols) == 1 || len(cols[1]) < 1 {
+					client.ReplyNotEnoughParameters("KILL")
+					continue
+				}
+				args := strings.SplitN(cols[1], " ", 2)
+				if len(args) < 2 {
+					client.ReplyNotEnoughParameters("KILL")
+					continue
+				}
+				daemon.HandlerKill(client, args[0], strings.TrimLeft(args[1], ":"))
 			case "LIST":
 				daemon.SendList(client, cols)
 			case "LUSERS":
-				go daemon.SendLusers(client)
+				daemon.SendLusers(client)
 			case "MODE":
 				if len(cols) == 1 || len(cols[1]) < 1 {
 					client.ReplyNotEnoughParameters("MODE")
 					continue
 				}
 				cols = strings.SplitN(cols[1], " ", 2)
-				if cols[0] == client.username {
+				if strings.ToLower(cols[0]) == strings.ToLower(client.nickname) {
 					if len(cols) == 1 {
-						client.Msg("221 " + client.nickname + " +")
-					} else {
-						client.ReplyNicknamed("501", "Unknown MODE flag")
+						client.ReplyNicknamed("221", client.Modes())
+						continue
+					}
+					applied, unknown := client.ModesApply(strings.TrimLeft(cols[1], ":"))
+					if applied != "" {
+						client.Msg(fmt.Sprintf(":%s MODE %s :%s", client.Hostmask(), client.nickname, applied))
+					}
+					for _, flag := range unknown {
+						client.ReplyNicknamed("501", string(flag), "Unknown MODE flag")
 					}
 					continue
 				}
 				room := cols[0]
-				r, found := daemon.rooms[room]
+				r, found := daemon.RoomByName(room)
 				if !found {
 					client.ReplyNoChannel(room)
 					continue
@@ -341,28 +2003,66 @@ func (daemon *Daemon) Processor(events <-chan ClientEvent) {
 					daemon.room_sinks[r] <- ClientEvent{client, EVENT_MODE, cols[1]}
 				}
 			case "MOTD":
-				go daemon.SendMotd(client)
+				daemon.SendMotd(client)
+			case "OPER":
+				if len(cols) == 1 || len(cols[1]) < 1 {
+					client.ReplyNotEnoughParameters("OPER")
+					continue
+				}
+				args := strings.SplitN(cols[1], " ", 2)
+				if len(args) < 2 {
+					client.ReplyNotEnoughParameters("OPER")
+					continue
+				}
+				if !CredentialsValid(daemon.Opers, args[0], strings.TrimLeft(args[1], ":")) {
+					client.ReplyNicknamed("464", "Password incorrect")
+					continue
+				}
+				client.operator = true
+				log.Println(client, "became IRC operator", args[0])
+				client.ReplyNicknamed("381", "You are now an IRC operator")
 			case "PART":
 				if len(cols) == 1 || len(cols[1]) < 1 {
 					client.ReplyNotEnoughParameters("PART")
 					continue
 				}
-				for _, room := range strings.Split(cols[1], ",") {
-					r, found := daemon.rooms[room]
+				args := strings.SplitN(cols[1], " ", 2)
+				reason := ""
+				if len(args) == 2 {
+					reason = strings.TrimLeft(args[1], ":")
+				}
+				for _, room := range strings.Split(args[0], ",") {
+					r, found := daemon.RoomByName(room)
 					if !found {
 						client.ReplyNoChannel(room)
 						continue
 					}
-					daemon.room_sinks[r] <- ClientEvent{client, EVENT_DEL, ""}
+					delete(client.rooms, r)
+					daemon.room_sinks[r] <- ClientEvent{client, EVENT_DEL, reason}
 				}
 			case "PING":
 				if len(cols) == 1 {
 					client.ReplyNicknamed("409", "No origin specified")
 					continue
 				}
-				client.Reply(fmt.Sprintf("PONG %s :%s", daemon.hostname, cols[1]))
+				// Either "PING token" or "PING token server" form
+				token := cols[1]
+				server := daemon.hostname
+				if !strings.HasPrefix(token, ":") {
+					if args := strings.SplitN(token, " ", 2); len(args) == 2 {
+						token = args[0]
+						server = strings.TrimLeft(args[1], ":")
+					}
+				}
+				client.Reply(fmt.Sprintf("PONG %s :%s", server, strings.TrimLeft(token, ":")))
 			case "PONG":
-				continue
+				if len(cols) == 1 {
+					continue
+				}
+				args := strings.Fields(cols[1])
+				if len(args) > 0 && client.ping_sent && strings.TrimLeft(args[len(args)-1], ":") == client.ping_token {
+					client.ping_sent = false
+				}
 			case "NOTICE", "PRIVMSG":
 				if len(cols) == 1 {
 					client.ReplyNicknamed("411", "No recipient given ("+command+")")
@@ -373,30 +2073,98 @@ func (daemon *Daemon) Processor(events <-chan ClientEvent) {
 					client.ReplyNicknamed("412", "No text to send")
 					continue
 				}
-				msg := ""
-				target := strings.ToLower(cols[0])
-				for c := range daemon.clients {
-					if c.nickname == target {
-						msg = fmt.Sprintf(":%s %s %s :%s", client, command, c.nickname, cols[1])
-						c.Msg(msg)
-						break
+				text := strings.TrimPrefix(cols[1], ":")
+				for _, target := range strings.Split(strings.ToLower(cols[0]), ",") {
+					if target != "" {
+						daemon.HandlerMsg(client, command, target, text)
 					}
 				}
-				if msg != "" {
+			case "PROTOCTL", "PROTOCOL":
+				if len(cols) == 1 {
 					continue
 				}
-				r, found := daemon.rooms[target]
-				if !found {
-					client.ReplyNoNickChan(target)
+				for _, token := range strings.Fields(strings.TrimLeft(cols[1], ":")) {
+					switch strings.ToUpper(token) {
+					case "NAMESX":
+						daemon.RoomsLock()
+						client.caps["multi-prefix"] = true
+						daemon.RoomsUnlock()
+					case "UHNAMES":
+						daemon.RoomsLock()
+						client.caps["userhost-in-names"] = true
+						daemon.RoomsUnlock()
+					}
+				}
+			case "REHASH":
+				if !client.operator {
+					client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+					continue
+				}
+				log.Println(client, "requested rehash")
+				client.ReplyNicknamed("382", "goircd", "Rehashing")
+				if err := daemon.Rehash(); err != nil {
+					log.Println("Rehash failed", err)
+					client.Reply(fmt.Sprintf("NOTICE %s :Rehash failed: %v", client.nickname, err))
+				}
+			case "RENAME":
+				if !client.operator {
+					client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+					continue
+				}
+				if len(cols) == 1 || len(cols[1]) < 1 {
+					client.ReplyNotEnoughParameters("RENAME")
+					continue
+				}
+				args := strings.SplitN(cols[1], " ", 3)
+				if len(args) < 2 {
+					client.ReplyNotEnoughParameters("RENAME")
+					continue
+				}
+				reason := ""
+				if len(args) == 3 {
+					reason = strings.TrimLeft(args[2], ":")
+				}
+				daemon.HandlerRename(client, args[0], args[1], reason)
+			case "SANICK":
+				if !client.operator {
+					client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+					continue
+				}
+				if len(cols) == 1 || len(cols[1]) < 1 {
+					client.ReplyNotEnoughParameters("SANICK")
+					continue
+				}
+				args := strings.Fields(cols[1])
+				if len(args) < 2 {
+					client.ReplyNotEnoughParameters("SANICK")
+					continue
+				}
+				daemon.HandlerSanick(client, args[0], args[1])
+			case "SETNAME":
+				if len(cols) == 1 || strings.TrimLeft(cols[1], ":") == "" {
+					if client.caps["standard-replies"] {
+						client.StandardReply("FAIL", "SETNAME", "INVALID_REALNAME", "Realname is empty")
+					} else {
+						client.ReplyNotEnoughParameters("SETNAME")
+					}
+					continue
+				}
+				daemon.HandlerSetname(client, strings.TrimLeft(cols[1], ":"))
+			case "TAGMSG":
+				if len(cols) == 1 {
+					client.ReplyNicknamed("411", "No recipient given (TAGMSG)")
+					continue
 				}
-				daemon.room_sinks[r] <- ClientEvent{client, EVENT_MSG, command + " " + strings.TrimLeft(cols[1], ":")}
+				daemon.HandlerTagmsg(client, strings.Split(cols[1], " ")[0], tags)
+			case "TIME":
+				client.ReplyNicknamed("391", daemon.hostname, time.Now().Format(time.RFC1123))
 			case "TOPIC":
 				if len(cols) == 1 {
 					client.ReplyNotEnoughParameters("TOPIC")
 					continue
 				}
 				cols = strings.SplitN(cols[1], " ", 2)
-				r, found := daemon.rooms[cols[0]]
+				r, found := daemon.RoomByName(cols[0])
 				if !found {
 					client.ReplyNoChannel(cols[0])
 					continue
@@ -408,18 +2176,45 @@ func (daemon *Daemon) Processor(events <-chan ClientEvent) {
 					change = ""
 				}
 				daemon.room_sinks[r] <- ClientEvent{client, EVENT_TOPIC, change}
+			case "USERHOST":
+				if len(cols) == 1 || len(cols[1]) < 1 {
+					client.ReplyNotEnoughParameters("USERHOST")
+					continue
+				}
+				daemon.SendUserhost(client, strings.Fields(cols[1]))
+			case "VERSION":
+				client.ReplyNicknamed("351", VERSION+".", daemon.hostname, "minimalistic simple IRC server")
+			case "WALLOPS":
+				if !client.operator {
+					client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+					continue
+				}
+				if len(cols) == 1 || strings.TrimLeft(cols[1], ":") == "" {
+					client.ReplyNotEnoughParameters("WALLOPS")
+					continue
+				}
+				msg := fmt.Sprintf(":%s WALLOPS :%s", client.Hostmask(), strings.TrimLeft(cols[1], ":"))
+				for c := range daemon.clients {
+					if c.registered && c.wallops {
+						c.Msg(msg)
+					}
+				}
 			case "WHO":
 				if len(cols) == 1 || len(cols[1]) < 1 {
 					client.ReplyNotEnoughParameters("WHO")
 					continue
 				}
 				room := strings.Split(cols[1], " ")[0]
-				r, found := daemon.rooms[room]
+				if !strings.HasPrefix(room, "#") && !strings.HasPrefix(room, "&") {
+					daemon.SendWhoMask(client, room)
+					continue
+				}
+				r, found := daemon.RoomByName(room)
 				if !found {
 					client.ReplyNoChannel(room)
 					continue
 				}
-				daemon.room_sinks[r] <- ClientEvent{client, EVENT_WHO, ""}
+				daemon.room_sinks[r] <- ClientEvent{client, EVENT_WHO, room}
 			case "WHOIS":
 				if len(cols) == 1 || len(cols[1]) < 1 {
 					client.ReplyNotEnoughParameters("WHOIS")
@@ -427,8 +2222,16 @@ func (daemon *Daemon) Processor(events <-chan ClientEvent) {
 				}
 				cols := strings.Split(cols[1], " ")
 				nicknames := strings.Split(cols[len(cols)-1], ",")
-				go daemon.SendWhois(client, nicknames)
+				daemon.SendWhois(client, nicknames)
+			case "STATS":
+				if len(cols) == 1 || len(cols[1]) < 1 {
+					client.ReplyNotEnoughParameters("STATS")
+					continue
+				}
+				daemon.SendStats(client, strings.Fields(cols[1])[0])
 			default:
+				// Do not count garbage
+				delete(daemon.commands, command)
 				client.ReplyNicknamed("421", command, "Unknown command")
 			}
 		}
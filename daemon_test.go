@@ -18,10 +18,24 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRegistrationWorkflow(t *testing.T) {
@@ -39,7 +53,7 @@ func TestRegistrationWorkflow(t *testing.T) {
 		t.Fatal("431 for NICK", r)
 	}
 
-	for _, n := range []string{"привет", " foo", "longlonglong", "#foo", "mein nick", "foo_bar"} {
+	for _, n := range []string{"привет", " foo", "longlonglong", "#foo", "mein nick", "foo.bar"} {
 		conn.inbound <- "NICK " + n
 		if r := <-conn.outbound; r != ":foohost 432 * "+n+" :Erroneous nickname\r\n" {
 			t.Fatal("nickname validation", r)
@@ -77,6 +91,9 @@ func TestRegistrationWorkflow(t *testing.T) {
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 004") {
 		t.Fatal("004 after registration", r)
 	}
+	if r := <-conn.outbound; r != ":foohost 005 meinick CHANTYPES=# CHANMODES=be,k,,Rmnps PREFIX=(ov)@+ NICKLEN=9 CHANNELLEN=201 NAMESX UHNAMES NETWORK=foohost :are supported by this server\r\n" {
+		t.Fatal("005 after registration", r)
+	}
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 251") {
 		t.Fatal("251 after registration", r)
 	}
@@ -88,10 +105,71 @@ func TestRegistrationWorkflow(t *testing.T) {
 	}
 
 	conn.inbound <- "AWAY"
+	if r := <-conn.outbound; r != ":foohost 305 meinick :You are no longer marked as being away\r\n" {
+		t.Fatal("reply for AWAY", r)
+	}
 	conn.inbound <- "UNEXISTENT CMD"
 	if r := <-conn.outbound; r != ":foohost 421 meinick UNEXISTENT :Unknown command\r\n" {
 		t.Fatal("reply for unexistent command", r)
 	}
+	conn.inbound <- "VERSION"
+	if r := <-conn.outbound; r != ":foohost 351 meinick "+VERSION+". foohost :minimalistic simple IRC server\r\n" {
+		t.Fatal("reply for VERSION", r)
+	}
+	conn.inbound <- "TIME"
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 391 meinick foohost :") {
+		t.Fatal("reply for TIME", r)
+	}
+	conn.inbound <- "INFO"
+	for i := 0; i < 3; i++ {
+		if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 371 meinick :") {
+			t.Fatal("reply for INFO", r)
+		}
+	}
+	if r := <-conn.outbound; r != ":foohost 374 meinick :End of /INFO list\r\n" {
+		t.Fatal("end of INFO", r)
+	}
+	conn.inbound <- "STATS"
+	if r := <-conn.outbound; r != ":foohost 461 meinick STATS :Not enough parameters\r\n" {
+		t.Fatal("STATS without query", r)
+	}
+	conn.inbound <- "STATS u"
+	if r := <-conn.outbound; r != ":foohost 242 meinick :Server Up 0 days 0:00:00\r\n" {
+		t.Fatal("STATS u", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 219 meinick u :End of STATS report\r\n" {
+		t.Fatal("end of STATS u", r)
+	}
+	conn.inbound <- "STATS m"
+	for _, expected := range []string{
+		":foohost 212 meinick AWAY :1\r\n",
+		":foohost 212 meinick INFO :1\r\n",
+		":foohost 212 meinick STATS :3\r\n",
+		":foohost 212 meinick TIME :1\r\n",
+		":foohost 212 meinick VERSION :1\r\n",
+		":foohost 219 meinick m :End of STATS report\r\n",
+	} {
+		if r := <-conn.outbound; r != expected {
+			t.Fatal("STATS m", r)
+		}
+	}
+	conn.inbound <- "ADMIN"
+	if r := <-conn.outbound; r != ":foohost 423 meinick foohost :No administrative info available\r\n" {
+		t.Fatal("reply for ADMIN without info", r)
+	}
+	daemon.AdminName = "John Doe"
+	daemon.AdminEmail = "john@example.com"
+	conn.inbound <- "ADMIN"
+	for _, expected := range []string{
+		":foohost 256 meinick foohost :Administrative info\r\n",
+		":foohost 257 meinick :\r\n",
+		":foohost 258 meinick :John Doe\r\n",
+		":foohost 259 meinick :john@example.com\r\n",
+	} {
+		if r := <-conn.outbound; r != expected {
+			t.Fatal("reply for ADMIN", r)
+		}
+	}
 
 	daemon.SendLusers(client)
 	if r := <-conn.outbound; !strings.Contains(r, "There are 1 users") {
@@ -102,10 +180,24 @@ func TestRegistrationWorkflow(t *testing.T) {
 	if r := <-conn.outbound; r != ":foohost PONG foohost :thishost\r\n" {
 		t.Fatal("PONG", r)
 	}
+	conn.inbound <- "PING :some token"
+	if r := <-conn.outbound; r != ":foohost PONG foohost :some token\r\n" {
+		t.Fatal("PONG for trailing token", r)
+	}
+	conn.inbound <- "PING 1234567 foohost"
+	if r := <-conn.outbound; r != ":foohost PONG foohost :1234567\r\n" {
+		t.Fatal("PONG for two arguments", r)
+	}
+	conn.inbound <- "PING 1234567 :otherhost"
+	if r := <-conn.outbound; r != ":foohost PONG otherhost :1234567\r\n" {
+		t.Fatal("PONG echoing both arguments", r)
+	}
 
 	conn.inbound <- "QUIT\r\nUNEXISTENT CMD"
-	<-conn.outbound
-	if !conn.closed {
+	if r := <-conn.outbound; r != "ERROR :Closing Link: meinick\r\n" {
+		t.Fatal("reply for QUIT", r)
+	}
+	if !conn.Closed() {
 		t.Fatal("closed connection on QUIT")
 	}
 }
@@ -133,3 +225,1949 @@ func TestMotd(t *testing.T) {
 		t.Fatalf("MOTD end: got %q, want prefix %q", got, want)
 	}
 }
+
+func TestLabeledResponse(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	conn1.inbound <- "CAP LS"
+	if r := expectMsg(t, conn1); r != ":foohost CAP nick1 LS :"+CAPABILITIES+"\r\n" {
+		t.Fatal("CAP LS", r)
+	}
+	conn1.inbound <- "CAP REQ :batch labeled-response message-tags"
+	if r := expectMsg(t, conn1); r != ":foohost CAP nick1 ACK :batch labeled-response message-tags\r\n" {
+		t.Fatal("CAP REQ", r)
+	}
+	conn2.inbound <- "CAP REQ :message-tags"
+	if r := expectMsg(t, conn2); r != ":foohost CAP nick2 ACK :message-tags\r\n" {
+		t.Fatal("CAP REQ", r)
+	}
+
+	conn1.inbound <- "@label=abc;+typing=active TAGMSG nick2"
+	if r := expectMsg(t, conn2); r != "@+typing=active :nick1!foo1@someclient TAGMSG nick2\r\n" {
+		t.Fatal("TAGMSG relay", r)
+	}
+	if r := expectMsg(t, conn1); r != "@label=abc :foohost ACK\r\n" {
+		t.Fatal("ACK for labeled TAGMSG", r)
+	}
+	conn1.inbound <- "@label=def PING foo"
+	if r := expectMsg(t, conn1); r != "@label=def :foohost PONG foohost :foo\r\n" {
+		t.Fatal("labeled single reply", r)
+	}
+
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn2, "#foo")
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN", r)
+	}
+	conn1.inbound <- "@label=mno;+typing=paused TAGMSG #foo"
+	if r := expectMsg(t, conn1); r != "@label=mno :foohost ACK\r\n" {
+		t.Fatal("ACK for labeled room TAGMSG", r)
+	}
+	if r := expectMsg(t, conn2); r != "@+typing=paused :nick1!foo1@someclient TAGMSG #foo\r\n" {
+		t.Fatal("room TAGMSG relay", r)
+	}
+	conn1.inbound <- "@label=ghi LIST"
+	if r := expectMsg(t, conn1); r != "@label=ghi :foohost BATCH +1 labeled-response\r\n" {
+		t.Fatal("labeled batch start", r)
+	}
+	if r := expectMsg(t, conn1); r != "@batch=1 :foohost 322 nick1 #foo 2 :\r\n" {
+		t.Fatal("labeled batch reply", r)
+	}
+	if r := expectMsg(t, conn1); r != "@batch=1 :foohost 323 nick1 :End of /LIST\r\n" {
+		t.Fatal("labeled batch reply", r)
+	}
+	if r := expectMsg(t, conn1); r != ":foohost BATCH -1\r\n" {
+		t.Fatal("labeled batch end", r)
+	}
+
+	conn2.inbound <- "@label=jkl PING foo"
+	if r := expectMsg(t, conn2); r != ":foohost PONG foohost :foo\r\n" {
+		t.Fatal("label without labeled-response", r)
+	}
+}
+
+func TestMotdLongLines(t *testing.T) {
+	fd, err := ioutil.TempFile("", "motd")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	lines := []string{
+		"first",
+		strings.Repeat("0123456789", 300),
+		"trailing spaces  ",
+		strings.Repeat("abc ", 400) + "end",
+		"",
+		"last",
+	}
+	fd.WriteString(strings.Join(lines[:5], "\n") + "\r\n" + lines[5] + "\n\n")
+	fd.Close()
+
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	daemon := NewDaemon("foohost", fd.Name(), nil, nil)
+	go daemon.SendMotd(client)
+	expectNumeric(t, conn, "375")
+	for _, line := range lines {
+		if r := expectMsg(t, conn); r != ":foohost 372 * :- "+line+"\r\n" {
+			t.Fatalf("MOTD line: got %q, want %q", r, line)
+		}
+	}
+	expectNumeric(t, conn, "376")
+}
+
+func TestMotdReload(t *testing.T) {
+	fd, err := ioutil.TempFile("", "motd")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("old\n")
+	fd.Close()
+
+	daemon := NewDaemon("foohost", fd.Name(), nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	_, conn := registerClient(t, daemon, events, "nick", "foo")
+
+	if err = ioutil.WriteFile(fd.Name(), []byte("new\n"), 0600); err != nil {
+		t.Fatal("can not rewrite MOTD", err)
+	}
+	conn.inbound <- "MOTD"
+	expectNumeric(t, conn, "375")
+	if r := expectMsg(t, conn); r != ":foohost 372 nick :- old\r\n" {
+		t.Fatal("cached MOTD", r)
+	}
+	expectNumeric(t, conn, "376")
+
+	events <- ClientEvent{nil, EVENT_RELOAD, ""}
+	conn.inbound <- "MOTD"
+	expectNumeric(t, conn, "375")
+	if r := expectMsg(t, conn); r != ":foohost 372 nick :- new\r\n" {
+		t.Fatal("reloaded MOTD", r)
+	}
+	expectNumeric(t, conn, "376")
+
+	os.Remove(fd.Name())
+	events <- ClientEvent{nil, EVENT_RELOAD, ""}
+	conn.inbound <- "MOTD"
+	if r := expectMsg(t, conn); r != ":foohost 422 nick :Error reading MOTD File\r\n" {
+		t.Fatal("missing MOTD reload", r)
+	}
+}
+
+func TestRehash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rehash")
+	if err != nil {
+		t.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	motd := path.Join(dir, "motd")
+	opers := path.Join(dir, "opers")
+	hash := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	ioutil.WriteFile(motd, []byte("old\n"), 0600)
+	ioutil.WriteFile(opers, []byte("admin:"+hash+"\n"), 0600)
+
+	daemon := NewDaemon("foohost", motd, nil, nil)
+	daemon.OpersFile = opers
+	if err = daemon.Rehash(); err != nil {
+		t.Fatal("initial rehash", err)
+	}
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	_, conn := registerClient(t, daemon, events, "nick", "foo")
+
+	conn.inbound <- "REHASH"
+	expectNumeric(t, conn, "481")
+	conn.inbound <- "OPER admin secret"
+	expectNumeric(t, conn, "381")
+
+	ioutil.WriteFile(motd, []byte("new\n"), 0600)
+	ioutil.WriteFile(opers, []byte("root:"+hash+"\n"), 0600)
+	conn.inbound <- "REHASH"
+	if r := expectMsg(t, conn); r != ":foohost 382 nick goircd :Rehashing\r\n" {
+		t.Fatal("REHASH reply", r)
+	}
+	conn.inbound <- "MOTD"
+	expectNumeric(t, conn, "375")
+	if r := expectMsg(t, conn); r != ":foohost 372 nick :- new\r\n" {
+		t.Fatal("rehashed MOTD", r)
+	}
+	expectNumeric(t, conn, "376")
+	conn.inbound <- "OPER admin secret"
+	expectNumeric(t, conn, "464")
+	conn.inbound <- "OPER root secret"
+	expectNumeric(t, conn, "381")
+
+	ioutil.WriteFile(opers, []byte("garbage\n"), 0600)
+	conn.inbound <- "REHASH"
+	expectNumeric(t, conn, "382")
+	if r := expectMsg(t, conn); !strings.HasPrefix(r, ":foohost NOTICE nick :Rehash failed: ") {
+		t.Fatal("failed REHASH", r)
+	}
+	if _, found := daemon.Opers["root"]; !found {
+		t.Fatal("credentials lost after failed rehash")
+	}
+}
+
+func TestOperOnlyChancreate(t *testing.T) {
+	log_sink := make(chan LogEvent, 8)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.OperOnlyChancreate = true
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client1, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	client1.operator = true
+
+	conn2.inbound <- "JOIN #foo"
+	if r := expectMsg(t, conn2); r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("channel creation by regular user", r)
+	}
+	conn1.inbound <- "JOIN #foo"
+	if r := expectMsg(t, conn1); r != ":foohost 331 nick1 #foo :No topic is set\r\n" {
+		t.Fatal("channel creation by operator", r)
+	}
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN by operator", r)
+	}
+	expectNumeric(t, conn1, "353")
+	expectNumeric(t, conn1, "366")
+	conn2.inbound <- "JOIN #foo"
+	if r := expectMsg(t, conn2); r != ":foohost 331 nick2 #foo :No topic is set\r\n" {
+		t.Fatal("joining existing channel by regular user", r)
+	}
+}
+
+func TestAway(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn2.inbound <- "AWAY :gone fishing"
+	if r := <-conn2.outbound; r != ":foohost 306 nick2 :You have been marked as being away\r\n" {
+		t.Fatal("306 for AWAY", r)
+	}
+	if client2.away != "gone fishing" {
+		t.Fatal("away message saved", client2.away)
+	}
+
+	conn1.inbound <- "PRIVMSG nick2 hello"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :hello\r\n" {
+		t.Fatal("message to away user", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 301 nick1 nick2 :gone fishing\r\n" {
+		t.Fatal("301 for message to away user", r)
+	}
+
+	conn1.inbound <- "WHOIS nick2"
+	for _, want := range []string{"311", "312", "301 nick1 nick2 :gone fishing", "317", "319", "318"} {
+		if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost "+want) {
+			t.Fatal("WHOIS of away user", want, r)
+		}
+	}
+	conn1.inbound <- "WHO nick2"
+	if r := <-conn1.outbound; r != ":foohost 352 nick1 * foo2 someclient foohost nick2 G :0 Long name2\r\n" {
+		t.Fatal("WHO of away user", r)
+	}
+	expectNumeric(t, conn1, "315")
+	joinRoom(t, conn2, "#foo")
+	conn1.inbound <- "WHO #foo"
+	if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 352 nick1 #foo foo2 ") || !strings.Contains(r, " nick2 G@ :0 Long name2") {
+		t.Fatal("room WHO of away user", r)
+	}
+	expectNumeric(t, conn1, "315")
+
+	conn2.inbound <- "AWAY"
+	if r := <-conn2.outbound; r != ":foohost 305 nick2 :You are no longer marked as being away\r\n" {
+		t.Fatal("305 for AWAY", r)
+	}
+	conn1.inbound <- "PRIVMSG nick2 hello"
+	<-conn2.outbound
+	conn1.inbound <- "WHOIS nick2"
+	for _, want := range []string{"311", "312", "317", "319", "318"} {
+		if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost "+want) {
+			t.Fatal("WHOIS of returned user", want, r)
+		}
+	}
+}
+
+func TestIson(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	registerClient(t, daemon, events, "Nick2", "foo2")
+
+	conn1.inbound <- "ISON"
+	expectNumeric(t, conn1, "461")
+	conn1.inbound <- "ISON nick3 nick2 foo NICK1"
+	if r := expectMsg(t, conn1); r != ":foohost 303 nick1 :Nick2 nick1\r\n" {
+		t.Fatal("ISON", r)
+	}
+	conn1.inbound <- "ISON :nick3 nick4"
+	if r := expectMsg(t, conn1); r != ":foohost 303 nick1 :\r\n" {
+		t.Fatal("ISON with nobody online", r)
+	}
+}
+
+func TestBadNames(t *testing.T) {
+	log_sink := make(chan LogEvent, 8)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.BadNicks = []string{"root", "*serv"}
+	daemon.BadChans = []string{"#warez*"}
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+
+	for _, n := range []string{"root", "NickServ"} {
+		conn.inbound <- "NICK " + n
+		if r := <-conn.outbound; r != ":foohost 432 * "+n+" :Erroneous nickname\r\n" {
+			t.Fatal("forbidden nickname", r)
+		}
+	}
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn.outbound
+	}
+
+	conn.inbound <- "JOIN #Warez-0day"
+	if r := <-conn.outbound; r != ":foohost 479 nick1 #Warez-0day :Illegal channel name\r\n" {
+		t.Fatal("forbidden channel", r)
+	}
+	client.operator = true
+	conn.inbound <- "JOIN #warez"
+	if r := <-conn.outbound; r != ":foohost 331 nick1 #warez :No topic is set\r\n" {
+		t.Fatal("forbidden channel for operator", r)
+	}
+}
+
+func TestNicknameCharset(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	for _, nickname := range []string{"nick_1", "[away]", "a^b`c", "{x}|y", "back\\sl", "-dash-", "123456789"} {
+		if !daemon.NicknameValid(nickname) {
+			t.Fatal("valid nickname is rejected", nickname)
+		}
+	}
+	for _, nickname := range []string{"*", "a*b", "nick.1", "nick!", "a@b", "#nick", "nick name", "", "1234567890"} {
+		if daemon.NicknameValid(nickname) {
+			t.Fatal("invalid nickname is accepted", nickname)
+		}
+	}
+	daemon.NicknameLen = 16
+	if !daemon.NicknameValid("sixteen_letters_") || daemon.NicknameValid("seventeen_letters") {
+		t.Fatal("configured nickname length is not applied")
+	}
+	if problems := daemon.validateISupport(); len(problems) != 0 {
+		t.Fatal("NICKLEN does not follow configured length", problems)
+	}
+	daemon.NicknameLen = 6
+	daemon.guests = 9
+	if nickname := daemon.GuestNickname(); nickname != "Gues10" {
+		t.Fatal("guest nickname does not fit NICKLEN", nickname)
+	}
+	daemon.NicknameLen = NICKNAME_LEN
+
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+	conn.inbound <- "NICK *"
+	if r := expectMsg(t, conn); r != ":foohost 432 * * :Erroneous nickname\r\n" {
+		t.Fatal("unregistered sentinel nickname", r)
+	}
+	conn.inbound <- "NICK [bot]_\r\nUSER foo1 bar1 baz1 :Long name1"
+	if r := expectMsg(t, conn); r != ":foohost 001 [bot]_ :Hi, welcome to IRC\r\n" {
+		t.Fatal("registration with special characters", r)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"foo", "FOO", true},
+		{"f?o", "fao", true},
+		{"f?o", "fo", false},
+		{"*!*@host", "nick!user@host", true},
+		{"*!*@*host", "nick!user@otherhost", true},
+		{"*!*@host", "nick!user@hosts", false},
+		{"n*k*", "nick!user@host", true},
+		{"", "", true},
+		{"*", "", true},
+		{"**", "abc", true},
+		{"a*", "", false},
+		{"*b", "aab", true},
+		{"*a?c*", "xxabcx", true},
+		{"*a*b", "aaa", false},
+	} {
+		if GlobMatch(c.pattern, c.s) != c.match {
+			t.Fatal("glob matching", c.pattern, c.s)
+		}
+	}
+
+	// Exponential backtracking would take ages on it
+	start := time.Now()
+	if GlobMatch("*a*a*a*a*a*a*a*a*a*a*a*a*b", "nick!"+strings.Repeat("a", 60)+"@1.2.3.4") {
+		t.Fatal("pathological pattern matches")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("pathological pattern matching is too slow", elapsed)
+	}
+}
+
+func TestUserhost(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+
+	conn1.inbound <- "USERHOST"
+	expectNumeric(t, conn1, "461")
+	conn2.inbound <- "AWAY :gone"
+	expectNumeric(t, conn2, "306")
+	conn1.inbound <- "USERHOST nick1 nick3 NICK2"
+	if r := expectMsg(t, conn1); r != ":foohost 302 nick1 :nick1=+foo1@someclient nick2=-foo2@someclient\r\n" {
+		t.Fatal("USERHOST", r)
+	}
+	conn1.inbound <- "USERHOST nick3 nick3 nick3 nick3 nick3 nick1"
+	if r := expectMsg(t, conn1); r != ":foohost 302 nick1 :\r\n" {
+		t.Fatal("USERHOST with more than five nicknames", r)
+	}
+}
+
+func TestAwayWindow(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	daemon.AwayWindow = time.Hour
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn2.inbound <- "AWAY :gone fishing"
+	<-conn2.outbound
+	for i := 0; i < 3; i++ {
+		conn1.inbound <- "PRIVMSG nick2 :hello"
+		<-conn2.outbound
+	}
+	conn1.inbound <- "ISON nick2"
+	if r := <-conn1.outbound; r != ":foohost 301 nick1 nick2 :gone fishing\r\n" {
+		t.Fatal("301 for first message", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 303 nick1 :nick2\r\n" {
+		t.Fatal("single 301 for several messages", r)
+	}
+}
+
+func TestOper(t *testing.T) {
+	fd, err := ioutil.TempFile("", "opers")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	// sha256("secret")
+	fd.WriteString("# IRC operators\nadmin:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b\n")
+	fd.Close()
+	opers, err := ReadCredentials(fd.Name())
+	if err != nil {
+		t.Fatalf("can not read credentials: %v", err)
+	}
+
+	daemon := NewDaemon("foohost", "", nil, nil)
+	daemon.Opers = opers
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn.outbound
+	}
+
+	conn.inbound <- "OPER admin"
+	not_enough_params(t, conn)
+	conn.inbound <- "OPER admin wrong"
+	if r := <-conn.outbound; r != ":foohost 464 nick1 :Password incorrect\r\n" {
+		t.Fatal("OPER with wrong password", r)
+	}
+	conn.inbound <- "OPER root secret"
+	if r := <-conn.outbound; r != ":foohost 464 nick1 :Password incorrect\r\n" {
+		t.Fatal("OPER with unknown name", r)
+	}
+	if client.operator {
+		t.Fatal("operator after failed OPER")
+	}
+	conn.inbound <- "WHOIS nick1"
+	expectNumeric(t, conn, "311")
+	expectNumeric(t, conn, "312")
+	expectNumeric(t, conn, "317")
+	expectNumeric(t, conn, "319")
+	expectNumeric(t, conn, "318")
+	conn.inbound <- "OPER admin secret"
+	if r := <-conn.outbound; r != ":foohost 381 nick1 :You are now an IRC operator\r\n" {
+		t.Fatal("OPER", r)
+	}
+	if !client.operator {
+		t.Fatal("operator after OPER")
+	}
+	conn.inbound <- "WHOIS nick1"
+	expectNumeric(t, conn, "311")
+	expectNumeric(t, conn, "312")
+	if r := expectMsg(t, conn); r != ":foohost 313 nick1 nick1 :is an IRC operator\r\n" {
+		t.Fatal("operator WHOIS", r)
+	}
+}
+
+func TestStatesLoad(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "states")
+	if err != nil {
+		t.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(statedir)
+	for name, contents := range map[string]string{
+		"#good":      "Some topic\nkey\n*!*@badhost nick!*@*\n",
+		"#nokey":     "Some topic\n\n",
+		"#empty":     "",
+		"#truncated": "Some topic",
+		"#badkey":    "Some topic\nbad key\n",
+		"#json":      `{"topic":"JSON topic","key":"key","bans":["*!*@badhost"],"future_mode":true}`,
+		"#jsonempty": `{}`,
+		"#jsonbad":   `{"topic":"JSON topic`,
+		"#jsonkey":   `{"key":"bad,key"}`,
+	} {
+		if err := ioutil.WriteFile(path.Join(statedir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("can not write state: %v", err)
+		}
+	}
+
+	daemon := NewDaemon("foohost", "", nil, nil)
+	if err := daemon.StatesLoad(statedir); err != nil {
+		t.Fatal("loading states", err)
+	}
+	if len(daemon.rooms) != 4 {
+		t.Fatal("corrupted states are skipped", daemon.rooms)
+	}
+	if r := daemon.rooms["#good"]; (r == nil) || (r.topic != "Some topic") || (r.key != "key") || (len(r.bans) != 2) {
+		t.Fatal("#good state", r)
+	}
+	if r := daemon.rooms["#nokey"]; (r == nil) || (r.topic != "Some topic") || (r.key != "") {
+		t.Fatal("#nokey state", r)
+	}
+	if r := daemon.rooms["#json"]; (r == nil) || (r.topic != "JSON topic") || (r.key != "key") || (len(r.bans) != 1) {
+		t.Fatal("#json state", r)
+	}
+	if r := daemon.rooms["#jsonempty"]; (r == nil) || (r.topic != "") || (r.key != "") || (r.created.IsZero()) {
+		t.Fatal("#jsonempty state", r)
+	}
+}
+
+func TestUserModes(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	daemon.DefaultUmodes = "+i"
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client, conn := registerClient(t, daemon, events, "nick1", "foo1")
+	if r := expectMsg(t, conn); r != ":nick1!foo1@someclient MODE nick1 :+i\r\n" {
+		t.Fatal("default user modes", r)
+	}
+	if !client.invisible {
+		t.Fatal("client is not invisible")
+	}
+
+	conn.inbound <- "MODE nick1"
+	if r := expectMsg(t, conn); r != ":foohost 221 nick1 :+i\r\n" {
+		t.Fatal("user modes", r)
+	}
+	daemon.SendLusers(client)
+	if r := expectNumeric(t, conn, "251"); !strings.Contains(r, "There are 0 users and 1 invisible") {
+		t.Fatal("LUSERS with invisible", r)
+	}
+
+	client.operator = true
+	conn.inbound <- "MODE NICK1 -io"
+	if r := expectMsg(t, conn); r != ":nick1!foo1@someclient MODE nick1 :-io\r\n" {
+		t.Fatal("removing user modes", r)
+	}
+	if client.operator || client.invisible {
+		t.Fatal("user modes are not removed")
+	}
+	conn.inbound <- "MODE nick1 +o"
+	conn.inbound <- "MODE nick1 +xy"
+	if r := expectMsg(t, conn); r != ":foohost 501 nick1 x :Unknown MODE flag\r\n" {
+		t.Fatal("unknown user mode", r)
+	}
+	if r := expectMsg(t, conn); r != ":foohost 501 nick1 y :Unknown MODE flag\r\n" {
+		t.Fatal("second unknown user mode", r)
+	}
+	conn.inbound <- "MODE nick1"
+	if r := expectMsg(t, conn); r != ":foohost 221 nick1 :+\r\n" {
+		t.Fatal("user modes after removal", r)
+	}
+}
+
+func TestNicknamesIndex(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client1, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	conn2 := NewTestingConn()
+	client2 := NewClient("foohost", conn2)
+	go client2.Processor(events)
+	conn2.inbound <- "NICK NICK1"
+	if r := expectMsg(t, conn2); r != ":foohost 433 * NICK1 :Nickname is already in use\r\n" {
+		t.Fatal("case insensitive nickname collision", r)
+	}
+	conn2.inbound <- "NICK nick2\r\nNICK nick3\r\nUSER foo2 bar2 baz2 :Long name2"
+	expectWelcome(t, conn2)
+	conn1.inbound <- "ISON nick2 NICK3"
+	if r := expectMsg(t, conn1); r != ":foohost 303 nick1 :nick3\r\n" {
+		t.Fatal("nickname released after change", r)
+	}
+
+	events <- ClientEvent{client1, EVENT_DEL, ""}
+	conn2.inbound <- "ISON nick1"
+	if r := expectMsg(t, conn2); r != ":foohost 303 nick3 :\r\n" {
+		t.Fatal("nickname released after disconnect", r)
+	}
+	if len(daemon.nicknames) != 1 {
+		t.Fatal("nicknames index", daemon.nicknames)
+	}
+}
+
+func TestSetname(t *testing.T) {
+	log_sink := make(chan LogEvent, 8)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn2.inbound <- "CAP LS"
+	if r := <-conn2.outbound; r != ":foohost CAP nick2 LS :"+CAPABILITIES+"\r\n" {
+		t.Fatal("CAP LS", r)
+	}
+	conn2.inbound <- "CAP REQ :setname foo"
+	if r := <-conn2.outbound; r != ":foohost CAP nick2 NAK :setname foo\r\n" {
+		t.Fatal("CAP REQ unknown", r)
+	}
+	conn2.inbound <- "CAP REQ :setname"
+	if r := <-conn2.outbound; r != ":foohost CAP nick2 ACK :setname\r\n" {
+		t.Fatal("CAP REQ", r)
+	}
+	conn2.inbound <- "CAP LIST"
+	if r := <-conn2.outbound; r != ":foohost CAP nick2 LIST :setname\r\n" {
+		t.Fatal("CAP LIST", r)
+	}
+	conn2.inbound <- "CAP REQ :away-notify"
+	<-conn2.outbound
+	conn2.inbound <- "CAP LIST"
+	if r := <-conn2.outbound; r != ":foohost CAP nick2 LIST :away-notify setname\r\n" {
+		t.Fatal("CAP LIST with two capabilities", r)
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+
+	conn1.inbound <- "SETNAME"
+	not_enough_params(t, conn1)
+	conn1.inbound <- "SETNAME :New name"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient SETNAME :New name\r\n" {
+		t.Fatal("SETNAME broadcast", r)
+	}
+	conn2.inbound <- "WHOIS nick1"
+	if r := <-conn2.outbound; r != ":foohost 311 nick2 nick1 foo1 someclient * :New name\r\n" {
+		t.Fatal("WHOIS after SETNAME", r)
+	}
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	conn1.inbound <- "PRIVMSG nick2 :hello"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :hello\r\n" {
+		t.Fatal("SETNAME sent to incapable client", r)
+	}
+}
+
+func TestWallops(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	conn3 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	client3 := NewClient("foohost", conn3)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	go client3.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	conn3.inbound <- "NICK nick3\r\nUSER foo3 bar3 baz3 :Long name3\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+		<-conn3.outbound
+	}
+
+	conn1.inbound <- "WALLOPS :hello"
+	if r := <-conn1.outbound; r != ":foohost 481 nick1 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("WALLOPS by non operator", r)
+	}
+	conn2.inbound <- "MODE nick2 +w"
+	if r := <-conn2.outbound; r != ":nick2!foo2@someclient MODE nick2 :+w\r\n" {
+		t.Fatal("wallops user mode", r)
+	}
+	client1.operator = true
+	conn1.inbound <- "WALLOPS"
+	not_enough_params(t, conn1)
+	conn1.inbound <- "WALLOPS :hello all"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient WALLOPS :hello all\r\n" {
+		t.Fatal("WALLOPS", r)
+	}
+	conn1.inbound <- "PRIVMSG nick3 :hello"
+	if r := <-conn3.outbound; r != ":nick1!foo1@someclient PRIVMSG nick3 :hello\r\n" {
+		t.Fatal("WALLOPS sent to client without +w", r)
+	}
+}
+
+func TestAutoAway(t *testing.T) {
+	log_sink := make(chan LogEvent, 8)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.AutoAway = time.Millisecond
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn2.outbound
+	}
+	conn2.inbound <- "CAP REQ :away-notify"
+	<-conn2.outbound
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+
+	time.Sleep(2 * time.Millisecond)
+	daemon.last_aliveness_check = time.Time{}
+	conn2.inbound <- "PING foohost"
+	if r := <-conn1.outbound; r != ":foohost 306 nick1 :You have been marked as being away\r\n" {
+		t.Fatal("auto away", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient AWAY :"+AUTO_AWAY_MESSAGE+"\r\n" {
+		t.Fatal("auto away notification", r)
+	}
+	<-conn2.outbound
+
+	conn1.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn1.outbound; r != ":foohost 305 nick1 :You are no longer marked as being away\r\n" {
+		t.Fatal("auto away cleared", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient AWAY\r\n" {
+		t.Fatal("auto away cleared notification", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG #foo :hello\r\n" {
+		t.Fatal("message after auto away", r)
+	}
+}
+
+type TestingAddr string
+
+func (a TestingAddr) String() string {
+	return string(a)
+}
+func (a TestingAddr) Network() string {
+	return "tcp"
+}
+
+func TestConnClasses(t *testing.T) {
+	fd, err := ioutil.TempFile("", "classes")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("# trusted\n10.0.0.0/8 20 10m 65536\n\n0.0.0.0/0 2 2m 0\n")
+	fd.Close()
+
+	classes, err := ReadConnClasses(fd.Name())
+	if err != nil {
+		t.Fatal("reading connection classes", err)
+	}
+	if len(classes) != 2 {
+		t.Fatal("connection classes", classes)
+	}
+	if c := ConnClassLookup(classes, TestingAddr("10.1.2.3:12345")); (c == nil) || (c.max_per_ip != 20) || (c.ping_timeout != 10*time.Minute) || (c.sendq != 65536) {
+		t.Fatal("trusted connection class", c)
+	}
+	if c := ConnClassLookup(classes, TestingAddr("192.168.1.1:12345")); (c == nil) || (c.max_per_ip != 2) || (c.ping_timeout != 2*time.Minute) || (c.sendq != 0) {
+		t.Fatal("default connection class", c)
+	}
+	if c := ConnClassLookup(classes, TestingAddr("[::1]:12345")); c != nil {
+		t.Fatal("unmatched connection class", c)
+	}
+	client := NewClient("foohost", NewTestingConn())
+	if client.PingTimeout() != PING_TIMEOUT {
+		t.Fatal("ping timeout without class")
+	}
+	client.class = classes[0]
+	if client.PingTimeout() != 10*time.Minute {
+		t.Fatal("ping timeout of class")
+	}
+
+	fd, err = ioutil.TempFile("", "classes")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("10.0.0.0/33 20 10m 0\n")
+	fd.Close()
+	if _, err := ReadConnClasses(fd.Name()); err == nil {
+		t.Fatal("invalid connection class is accepted")
+	}
+	fd, err = ioutil.TempFile("", "classes")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("10.0.0.0/8 20 1m 0\n")
+	fd.Close()
+	if _, err := ReadConnClasses(fd.Name()); err == nil {
+		t.Fatal("ping timeout below PING_THRESHOLD is accepted")
+	}
+	for _, line := range []string{"10.0.0.0/8 20 10m", "10.0.0.0/8 20 10m -1"} {
+		fd, err = ioutil.TempFile("", "classes")
+		if err != nil {
+			t.Fatalf("can not create temporary file: %v", err)
+		}
+		defer os.Remove(fd.Name())
+		fd.WriteString(line + "\n")
+		fd.Close()
+		if _, err := ReadConnClasses(fd.Name()); err == nil {
+			t.Fatal("invalid sendq is accepted", line)
+		}
+	}
+
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	client1.class = &ConnClass{max_per_ip: 1}
+	client2.class = client1.class
+	go client1.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+	}
+	go client2.Processor(events)
+	if r := <-conn2.outbound; r != "ERROR :Too many connections from your host\r\n" {
+		t.Fatal("max connections per host", r)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "NOTICE $* :maintenance"
+	if r := <-conn1.outbound; r != ":foohost 481 nick1 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("broadcast by non operator", r)
+	}
+	client1.operator = true
+	conn1.inbound <- "NOTICE $otherhost :maintenance"
+	if r := <-conn1.outbound; r != ":foohost 402 nick1 $otherhost :No such server\r\n" {
+		t.Fatal("broadcast to another server", r)
+	}
+	conn1.inbound <- "PRIVMSG $* :maintenance in 5 minutes"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :maintenance in 5 minutes\r\n" {
+		t.Fatal("broadcast to operator", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :maintenance in 5 minutes\r\n" {
+		t.Fatal("broadcast", r)
+	}
+}
+
+func TestRegTimeout(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+	}
+	go client2.Processor(events)
+	conn2.inbound <- "NICK"
+	<-conn2.outbound
+
+	daemon.RegTimeout = time.Millisecond
+	daemon.last_aliveness_check = time.Time{}
+	time.Sleep(2 * time.Millisecond)
+	conn1.inbound <- "PING foohost"
+	if r := <-conn2.outbound; r != "ERROR :Registration timeout\r\n" {
+		t.Fatal("registration timeout", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost PONG foohost :foohost\r\n" {
+		t.Fatal("registered client is disconnected", r)
+	}
+}
+
+func TestPendingPing(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn.outbound
+	}
+	client.ping_sent = true
+	client.ping_token = "sometoken"
+	client.ping_time = time.Now()
+
+	conn.inbound <- "ISON nick1"
+	<-conn.outbound
+	if !client.ping_sent {
+		t.Fatal("pending ping is cleared by non PONG traffic")
+	}
+	conn.inbound <- "PONG foohost :othertoken\r\nISON nick1"
+	<-conn.outbound
+	if !client.ping_sent {
+		t.Fatal("pending ping is cleared by PONG with another token")
+	}
+	conn.inbound <- "PONG foohost :sometoken\r\nISON nick1"
+	<-conn.outbound
+	if client.ping_sent {
+		t.Fatal("pending ping is not cleared by PONG")
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+
+	conn.inbound <- "CAP LS 302"
+	if r := <-conn.outbound; r != ":foohost CAP * LS :"+CAPABILITIES+"\r\n" {
+		t.Fatal("CAP LS before registration", r)
+	}
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP REQ :setname"
+	if r := <-conn.outbound; r != ":foohost CAP nick1 ACK :setname\r\n" {
+		t.Fatal("registration is not deferred during CAP negotiation", r)
+	}
+	if client.registered {
+		t.Fatal("client registered during CAP negotiation")
+	}
+	conn.inbound <- "CAP END"
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 001 nick1 ") {
+		t.Fatal("registration after CAP END", r)
+	}
+	for i := 0; i < 6; i++ {
+		<-conn.outbound
+	}
+	if !client.registered || !client.caps["setname"] {
+		t.Fatal("client after CAP negotiation")
+	}
+}
+
+func TestMaxUnregistered(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	daemon.MaxUnregistered = 2
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conns := []*TestingConn{}
+	clients := []*Client{}
+	for i := 0; i < 4; i++ {
+		conn := NewTestingConn()
+		conns = append(conns, conn)
+		clients = append(clients, NewClient("foohost", conn))
+	}
+	for i := 0; i < 2; i++ {
+		go clients[i].Processor(events)
+		conns[i].inbound <- "NICK"
+		if r := <-conns[i].outbound; r != ":foohost 431 :No nickname given\r\n" {
+			t.Fatal("unregistered connection", r)
+		}
+	}
+	go clients[2].Processor(events)
+	if r := <-conns[2].outbound; r != "ERROR :Too many unregistered connections, try again later\r\n" {
+		t.Fatal("unregistered connections over limit", r)
+	}
+	conns[2].inbound <- "NICK nick3"
+
+	conns[0].inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conns[0].outbound
+	}
+	go clients[3].Processor(events)
+	conns[3].inbound <- "NICK nick3\r\nUSER foo3 bar3 baz3 :Long name3\r\n"
+	if r := <-conns[3].outbound; !strings.HasPrefix(r, ":foohost 001 nick3 ") {
+		t.Fatal("connection after registration", r)
+	}
+}
+
+func TestSaslPlain(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	// sha256("secret")
+	daemon.Accounts = map[string]string{"bot": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+
+	conn.inbound <- "CAP LS\r\nCAP REQ :sasl\r\nNICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	<-conn.outbound
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE EXTERNAL"
+	if r := <-conn.outbound; r != ":foohost 908 nick1 PLAIN :are available SASL mechanisms\r\n" {
+		t.Fatal("unsupported SASL mechanism", r)
+	}
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	if r := <-conn.outbound; r != "AUTHENTICATE +\r\n" {
+		t.Fatal("SASL PLAIN start", r)
+	}
+	conn.inbound <- "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00bot\x00wrong"))
+	if r := <-conn.outbound; r != ":foohost 904 nick1 :SASL authentication failed\r\n" {
+		t.Fatal("SASL PLAIN with wrong password", r)
+	}
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("bot\x00bot\x00secret"))
+	if r := <-conn.outbound; r != ":foohost 900 nick1 nick1!foo1@someclient bot :You are now logged in as bot\r\n" {
+		t.Fatal("SASL PLAIN logged in", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 903 nick1 :SASL authentication successful\r\n" {
+		t.Fatal("SASL PLAIN success", r)
+	}
+	conn.inbound <- "CAP END"
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 001 nick1 ") {
+		t.Fatal("registration after SASL", r)
+	}
+	if client.account != "bot" {
+		t.Fatal("SASL account", client.account)
+	}
+
+	// Payloads longer than SASL_CHUNK are sent in chunks
+	long := strings.Repeat("b", 300)
+	daemon.Accounts[long] = daemon.Accounts["bot"]
+	daemon.Accounts[long[:292]] = daemon.Accounts["bot"]
+	conn = NewTestingConn()
+	client = NewClient("foohost", conn)
+	go client.Processor(events)
+	conn.inbound <- "CAP REQ :sasl\r\nAUTHENTICATE PLAIN"
+	<-conn.outbound
+	<-conn.outbound
+	payload := base64.StdEncoding.EncodeToString([]byte("\x00" + long + "\x00secret"))
+	conn.inbound <- "AUTHENTICATE " + payload[:SASL_CHUNK]
+	conn.inbound <- "AUTHENTICATE " + payload[SASL_CHUNK:]
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 900 ") {
+		t.Fatal("SASL PLAIN chunked payload", r)
+	}
+	<-conn.outbound
+	if client.account != long {
+		t.Fatal("SASL account from chunks", client.account)
+	}
+
+	// Payload of exactly SASL_CHUNK length is terminated with "+"
+	conn = NewTestingConn()
+	client = NewClient("foohost", conn)
+	go client.Processor(events)
+	conn.inbound <- "CAP REQ :sasl\r\nAUTHENTICATE PLAIN"
+	<-conn.outbound
+	<-conn.outbound
+	payload = base64.StdEncoding.EncodeToString([]byte("\x00" + long[:292] + "\x00secret"))
+	if len(payload) != SASL_CHUNK {
+		t.Fatal("payload length", len(payload))
+	}
+	conn.inbound <- "AUTHENTICATE " + payload
+	conn.inbound <- "AUTHENTICATE +"
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 900 ") {
+		t.Fatal("SASL PLAIN payload terminated with +", r)
+	}
+	<-conn.outbound
+
+	// Too long payload is rejected, too many failures disconnect
+	conn = NewTestingConn()
+	client = NewClient("foohost", conn)
+	go client.Processor(events)
+	conn.inbound <- "CAP REQ :sasl\r\nAUTHENTICATE PLAIN"
+	<-conn.outbound
+	<-conn.outbound
+	for i := 0; i <= SASL_LEN/SASL_CHUNK; i++ {
+		conn.inbound <- "AUTHENTICATE " + strings.Repeat("A", SASL_CHUNK)
+	}
+	if r := <-conn.outbound; r != ":foohost 905 * :SASL message too long\r\n" {
+		t.Fatal("SASL too long payload", r)
+	}
+	for i := 0; i < SASL_FAILURES; i++ {
+		conn.inbound <- "AUTHENTICATE PLAIN"
+		<-conn.outbound
+		conn.inbound <- "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00bot\x00wrong"))
+		if r := <-conn.outbound; r != ":foohost 904 * :SASL authentication failed\r\n" {
+			t.Fatal("SASL PLAIN failure", r)
+		}
+	}
+	if r := <-conn.outbound; r != "ERROR :Too many SASL authentication failures\r\n" {
+		t.Fatal("too many SASL failures", r)
+	}
+	if !conn.Closed() {
+		t.Fatal("connection is not closed after SASL failures")
+	}
+}
+
+func TestReserveNicks(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	// sha256("secret")
+	daemon.Accounts = map[string]string{"bot": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}
+	daemon.ReserveNicks = true
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "PASS wrong\r\nNICK Bot\r\nUSER foo1 bar1 baz1 :Long name1"
+	if r := <-conn1.outbound; r != ":foohost 433 * Bot :Nickname is reserved, you are renamed to Guest1\r\n" {
+		t.Fatal("unauthenticated reserved nickname", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 001 Guest1 :Hi, welcome to IRC\r\n" {
+		t.Fatal("registration as guest", r)
+	}
+	for i := 0; i < 6; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "PASS :secret\r\nNICK bot\r\nUSER foo2 bar2 baz2 :Long name2"
+	if r := <-conn2.outbound; r != ":foohost 001 bot :Hi, welcome to IRC\r\n" {
+		t.Fatal("registration with reserved nickname", r)
+	}
+	for i := 0; i < 6; i++ {
+		<-conn2.outbound
+	}
+	if client2.account != "bot" || client2.password != "" {
+		t.Fatal("PASS authentication", client2.account)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "states")
+	if err != nil {
+		t.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(statedir)
+	log_sink := make(chan LogEvent, 8)
+	state_sink := make(chan StateEvent)
+	states_done := make(chan struct{})
+	go func() {
+		StateKeeper(statedir, state_sink)
+		close(states_done)
+	}()
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	go client.Processor(events)
+
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "DIE"
+	if r := <-conn.outbound; r != ":foohost 481 nick1 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("DIE by non operator", r)
+	}
+	conn.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn.outbound
+	}
+	client.operator = true
+	conn.inbound <- "TOPIC #foo :New topic\r\nDIE"
+	<-conn.outbound
+	if r := <-conn.outbound; r != "ERROR :Server shutting down\r\n" {
+		t.Fatal("DIE", r)
+	}
+	<-states_done
+	data, err := ioutil.ReadFile(path.Join(statedir, "#foo"))
+	if err != nil {
+		t.Fatal("reading state after shutdown", err)
+	}
+	if !strings.HasPrefix(string(data), `{"topic":"New topic",`) {
+		t.Fatal("state after shutdown", string(data))
+	}
+}
+
+func TestResume(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.ResumeWindow = time.Minute
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "CAP REQ :draft/resume\r\nNICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+	}
+	r := <-conn1.outbound
+	if !strings.HasPrefix(r, ":foohost RESUME TOKEN ") {
+		t.Fatal("resume token issued", r)
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(r, ":foohost RESUME TOKEN "))
+	for i := 0; i < 7; i++ {
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+
+	// Connection is lost
+	events <- ClientEvent{client1, EVENT_DEL, ""}
+
+	conn3 := NewTestingConn()
+	client3 := NewClient("foohost", conn3)
+	go client3.Processor(events)
+	conn3.inbound <- "CAP REQ :draft/resume\r\nRESUME invalid"
+	<-conn3.outbound
+	if r := <-conn3.outbound; r != ":foohost RESUME ERR :Cannot resume connection, token is invalid\r\n" {
+		t.Fatal("invalid resume token", r)
+	}
+	conn3.inbound <- "RESUME " + token + "\r\nCAP END"
+	if r := <-conn3.outbound; r != ":foohost RESUME SUCCESS nick1\r\n" {
+		t.Fatal("resume success", r)
+	}
+	if r := <-conn3.outbound; r != ":foohost 001 nick1 :Hi, welcome to IRC\r\n" {
+		t.Fatal("welcome after resume", r)
+	}
+	for i := 0; i < 6; i++ {
+		<-conn3.outbound
+	}
+	if r := <-conn3.outbound; r != ":nick1!foo1@someclient JOIN #foo\r\n" {
+		t.Fatal("membership after resume", r)
+	}
+	<-conn3.outbound
+	if r := <-conn3.outbound; r != ":foohost 353 nick1 = #foo :@nick1 nick2\r\n" {
+		t.Fatal("operator status after resume", r)
+	}
+	<-conn3.outbound
+	if r := <-conn3.outbound; !strings.HasPrefix(r, ":foohost RESUME TOKEN ") || strings.Contains(r, token) {
+		t.Fatal("new resume token", r)
+	}
+
+	conn3.inbound <- "PRIVMSG #foo :back"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG #foo :back\r\n" {
+		t.Fatal("resume is not silent", r)
+	}
+	conn2.inbound <- "PRIVMSG nick1 :welcome back"
+	if r := <-conn3.outbound; r != ":nick2!foo2@someclient PRIVMSG nick1 :welcome back\r\n" {
+		t.Fatal("message to resumed nickname", r)
+	}
+	if len(conn1.outbound) != 0 {
+		t.Fatal("message to detached connection", <-conn1.outbound)
+	}
+}
+
+func TestOriginPrefix(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn1.addr = TestingAddr("10.1.2.3:12345")
+	client1 := NewClient("foohost", conn1)
+	go client1.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	expectWelcome(t, conn1)
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn2, "#foo")
+	joinRoom(t, conn1, "#foo")
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@10.1.2.3 JOIN #foo\r\n" {
+		t.Fatal("JOIN prefix", r)
+	}
+	conn1.inbound <- "PRIVMSG nick2 :direct"
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@10.1.2.3 PRIVMSG nick2 :direct\r\n" {
+		t.Fatal("direct message prefix", r)
+	}
+	conn1.inbound <- "PRIVMSG #foo :relayed"
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@10.1.2.3 PRIVMSG #foo :relayed\r\n" {
+		t.Fatal("channel message prefix", r)
+	}
+	conn2.inbound <- "WHO #foo"
+	if r := expectMsg(t, conn2); r != ":foohost 352 nick2 #foo foo1 10.1.2.3 foohost nick1 H :0 Long name1\r\n" {
+		t.Fatal("WHO host without port", r)
+	}
+	expectNumeric(t, conn2, "352")
+	expectNumeric(t, conn2, "315")
+}
+
+// Write self-signed certificate for name and its key to dir
+func testCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("can not generate key", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("can not create certificate", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("can not marshal key", err)
+	}
+	certfile := path.Join(dir, name+".crt")
+	keyfile := path.Join(dir, name+".key")
+	ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certfile, keyfile
+}
+
+func TestVHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vhosts")
+	if err != nil {
+		t.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	lines := []string{"# virtual hosts"}
+	for _, name := range []string{"irc.foo.example", "irc.bar.example"} {
+		certfile, keyfile := testCertificate(t, dir, name)
+		lines = append(lines, strings.Join([]string{name, certfile, keyfile, strings.Split(name, ".")[1] + "net"}, " "))
+	}
+	ioutil.WriteFile(path.Join(dir, "vhosts"), []byte(strings.Join(lines, "\n")), 0600)
+	vhosts, err := ReadVHosts(path.Join(dir, "vhosts"))
+	if err != nil || len(vhosts) != 2 {
+		t.Fatal("reading virtual hosts", vhosts, err)
+	}
+	certfile, keyfile := testCertificate(t, dir, "default.example")
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatal("default certificate", err)
+	}
+	config := VHostsTLSConfig(vhosts, cert)
+
+	for server_name, want := range map[string][2]string{
+		"irc.foo.example": {"irc.foo.example", "foonet"},
+		"IRC.Bar.example": {"irc.bar.example", "barnet"},
+		"unknown.example": {"default.example", ""},
+	} {
+		server, client := net.Pipe()
+		presented := make(chan string, 1)
+		go func() {
+			conn := tls.Client(client, &tls.Config{ServerName: server_name, InsecureSkipVerify: true})
+			if err := conn.Handshake(); err != nil {
+				presented <- err.Error()
+				return
+			}
+			presented <- conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}()
+		vhost := VHostHandshake(tls.Server(server, config), vhosts)
+		if name := <-presented; name != want[0] {
+			t.Fatal("certificate presented for", server_name, name)
+		}
+		if (vhost == nil && want[1] != "") || (vhost != nil && vhost.network != want[1]) {
+			t.Fatal("virtual host selected for", server_name, vhost)
+		}
+		server.Close()
+		client.Close()
+	}
+
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	client.nickname = "nick"
+	client.network = "foonet"
+	daemon := NewDaemon("foohost", "", nil, nil)
+	go daemon.SendWelcome(client)
+	expectNumeric(t, conn, "001")
+	for i := 0; i < 3; i++ {
+		expectMsg(t, conn)
+	}
+	if r := expectMsg(t, conn); !strings.Contains(r, " NETWORK=foonet :are supported") {
+		t.Fatal("virtual host network in ISUPPORT", r)
+	}
+	if problems := daemon.ISupportProblems([]string{"NETWORK=foo net"}); len(problems) == 0 {
+		t.Fatal("invalid network name is not caught")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	limiter := NewConnLimiter(3, time.Minute)
+	now := time.Unix(1234567890, 0)
+	addr1 := TestingAddr("10.1.2.3:12345")
+	addr2 := TestingAddr("[::1]:12345")
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(addr1, now.Add(time.Duration(i)*10*time.Second)) {
+			t.Fatal("connect within limit is rejected", i)
+		}
+	}
+	if limiter.Allow(TestingAddr("10.1.2.3:54321"), now.Add(30*time.Second)) {
+		t.Fatal("connect over limit is allowed")
+	}
+	if !limiter.Allow(addr2, now.Add(30*time.Second)) {
+		t.Fatal("connect from another address is rejected")
+	}
+	// The first connect leaves the window
+	if !limiter.Allow(addr1, now.Add(61*time.Second)) {
+		t.Fatal("connect after window slided is rejected")
+	}
+	if limiter.Allow(addr1, now.Add(62*time.Second)) {
+		t.Fatal("connect over limit in slided window is allowed")
+	}
+	limiter.Allow(addr1, now.Add(10*time.Minute))
+	if _, found := limiter.connects["::1"]; found || len(limiter.connects) != 1 {
+		t.Fatal("stale addresses are not pruned", limiter.connects)
+	}
+}
+
+// Listener accepting connections sent to it
+type TestingListener chan net.Conn
+
+func (l TestingListener) Accept() (net.Conn, error) {
+	return <-l, nil
+}
+func (l TestingListener) Close() error {
+	return nil
+}
+func (l TestingListener) Addr() net.Addr {
+	return nil
+}
+
+// Connection over the rate limit is told so and closed by Accept
+func TestConnectRate(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	limiter = NewConnLimiter(1, time.Minute)
+	defer func() { limiter = nil }()
+	listener := make(TestingListener)
+	go Accept(listener, events)
+
+	conn1 := NewTestingConn()
+	conn1.addr = TestingAddr("10.1.2.3:12345")
+	listener <- conn1
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	expectWelcome(t, conn1)
+
+	conn2 := NewTestingConn()
+	conn2.addr = TestingAddr("10.1.2.3:54321")
+	listener <- conn2
+	if r := expectMsg(t, conn2); r != "ERROR :Too many connections\r\n" {
+		t.Fatal("connect over limit", r)
+	}
+	if !conn2.Closed() {
+		t.Fatal("connection over limit is not closed")
+	}
+}
+
+func TestValidateISupport(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	if problems := daemon.validateISupport(); len(problems) != 0 {
+		t.Fatal("advertised ISUPPORT problems", problems)
+	}
+	for _, tokens := range [][]string{
+		{"CHANTYPES=#&", "CHANMODES=be,k,,Rmnps", "PREFIX=(ov)@+"},
+		{"CHANMODES=be,k,,Rmnpst", "PREFIX=(ov)@+"},
+		{"CHANMODES=be,k,Rmnps", "PREFIX=(ov)@+"},
+		{"CHANMODES=be,k,,Rmnps", "PREFIX=(qov)~@+"},
+		{"CHANMODES=be,k,,Rmnps", "PREFIX=(ov)+@"},
+		{"CHANMODES=be,k,,Rmnps", "PREFIX=(ov)@+", "INVEX"},
+		{"CHANMODES=be,k,,Rmnps", "PREFIX=(ov)@+", "NICKLEN=30"},
+		{"CHANMODES=be,k,,Rmnps", "PREFIX=(ov)@+", "NICKLEN=nine"},
+		{"CHANMODES=be,k,,Rmnps", "PREFIX=(ov)@+", "CHANNELLEN=50"},
+	} {
+		if problems := daemon.ISupportProblems(tokens); len(problems) == 0 {
+			t.Fatal("mis-advertised token is not caught", tokens)
+		}
+	}
+	if problems := daemon.ISupportProblems([]string{"CHANMODES=be,k,,Rmnp", "PREFIX=(ov)@+"}); len(problems) != 1 {
+		t.Fatal("not advertised mode is not caught", problems)
+	}
+}
+
+func TestIdleHidden(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	// sha256("secret")
+	daemon.Opers = map[string]string{"admin": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	_, conn3 := registerClient(t, daemon, events, "nick3", "foo3")
+
+	conn1.inbound <- "MODE nick1 +I"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE nick1 :+I\r\n" {
+		t.Fatal("+I", r)
+	}
+	conn2.inbound <- "WHOIS nick1"
+	expectNumeric(t, conn2, "311")
+	expectNumeric(t, conn2, "312")
+	expectNumeric(t, conn2, "319")
+	expectNumeric(t, conn2, "318")
+
+	conn3.inbound <- "OPER admin secret"
+	expectNumeric(t, conn3, "381")
+	conn3.inbound <- "WHOIS nick1"
+	expectNumeric(t, conn3, "311")
+	expectNumeric(t, conn3, "312")
+	expectNumeric(t, conn3, "317")
+	expectNumeric(t, conn3, "319")
+	expectNumeric(t, conn3, "318")
+
+	conn1.inbound <- "MODE nick1 -I"
+	expectMsg(t, conn1)
+	conn2.inbound <- "WHOIS nick1"
+	expectNumeric(t, conn2, "311")
+	expectNumeric(t, conn2, "312")
+	expectNumeric(t, conn2, "317")
+}
+
+func TestCtcp(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	_, conn := registerClient(t, daemon, events, "nick1", "foo1")
+
+	conn.inbound <- "PRIVMSG foohost :\x01VERSION\x01"
+	if r := expectMsg(t, conn); r != ":foohost NOTICE nick1 :\x01VERSION "+VERSION+"\x01\r\n" {
+		t.Fatal("default CTCP VERSION", r)
+	}
+	daemon.CtcpVersion = "branded 1.0"
+	daemon.CtcpSource = "https://example.com/src"
+	conn.inbound <- "PRIVMSG FOOHOST :\x01VERSION\x01"
+	if r := expectMsg(t, conn); r != ":foohost NOTICE nick1 :\x01VERSION branded 1.0\x01\r\n" {
+		t.Fatal("configured CTCP VERSION", r)
+	}
+	conn.inbound <- "NOTICE foohost :\x01VERSION\x01\r\nPRIVMSG foohost :\x01SOURCE\x01"
+	if r := expectMsg(t, conn); r != ":foohost NOTICE nick1 :\x01SOURCE https://example.com/src\x01\r\n" {
+		t.Fatal("configured CTCP SOURCE", r)
+	}
+}
+
+func TestListBatch(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	daemon.ListBatch = 10
+	rooms := 100
+	for i := 0; i < rooms; i++ {
+		daemon.RoomRegister(fmt.Sprintf("#room%04d", i))
+	}
+	registration := make(chan ClientEvent)
+	registered := make(chan struct{})
+	go func() {
+		daemon.Processor(registration)
+		close(registered)
+	}()
+	client1, conn1 := registerClient(t, daemon, registration, "nick1", "foo1")
+	client2, conn2 := registerClient(t, daemon, registration, "nick2", "foo2")
+	close(registration)
+	<-registered
+
+	// Other clients events are already waiting when LIST is processed
+	events := make(chan ClientEvent, 8)
+	events <- ClientEvent{client1, EVENT_MSG, "LIST"}
+	events <- ClientEvent{client2, EVENT_MSG, "PING foo"}
+	events <- ClientEvent{client1, EVENT_MSG, "LIST"}
+	go daemon.Processor(events)
+
+	for i := 0; i < rooms; i++ {
+		if i == daemon.ListBatch {
+			if r := expectMsg(t, conn1); r != ":foohost 263 nick1 LIST :Please wait a while and try again.\r\n" {
+				t.Fatal("repeated LIST", r)
+			}
+		}
+		if r := expectMsg(t, conn1); r != fmt.Sprintf(":foohost 322 nick1 #room%04d 0 :\r\n", i) {
+			t.Fatal("LIST entry", i, r)
+		}
+		if i == daemon.ListBatch-1 {
+			if r := expectMsg(t, conn2); r != ":foohost PONG foohost :foo\r\n" {
+				t.Fatal("PONG during LIST", r)
+			}
+		}
+	}
+	expectNumeric(t, conn1, "323")
+}
+
+func TestFlood(t *testing.T) {
+	client := NewClient("foohost", NewTestingConn())
+	now := time.Unix(1234567890, 0)
+	for i := 0; i < 3; i++ {
+		if !client.FloodCheck(2, 3, now) {
+			t.Fatal("burst is not allowed", i)
+		}
+	}
+	if client.FloodCheck(2, 3, now) {
+		t.Fatal("message over burst is allowed")
+	}
+	if !client.FloodCheck(2, 3, now.Add(500*time.Millisecond)) || client.FloodCheck(2, 3, now.Add(500*time.Millisecond)) {
+		t.Fatal("bucket is not refilled with rate")
+	}
+
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.FloodRate = 0.1
+	daemon.FloodBurst = 5
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn2, "#foo")
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN", r)
+	}
+
+	// NICK, USER and JOIN have already taken three tokens
+	conn2.inbound <- strings.TrimSuffix(strings.Repeat("PING foo\r\n", 10), "\r\n")
+	for i := 0; i < 2; i++ {
+		if r := expectMsg(t, conn2); r != ":foohost PONG foohost :foo\r\n" {
+			t.Fatal("PONG within burst", i, r)
+		}
+	}
+	if r := expectMsg(t, conn2); r != "ERROR :Excess flood\r\n" {
+		t.Fatal("flood disconnect", r)
+	}
+	if !conn2.Closed() {
+		t.Fatal("flooding connection is not closed")
+	}
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient QUIT :Excess Flood\r\n" {
+		t.Fatal("flood QUIT", r)
+	}
+}
+
+func TestStandardReplies(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.Opers = map[string]string{"admin": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	go client1.Processor(events)
+	conn1.inbound <- "CAP REQ :standard-replies\r\nNICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	expectNumeric(t, conn1, "CAP")
+	for i := 0; i < 7; i++ {
+		expectMsg(t, conn1)
+	}
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+
+	conn1.inbound <- "CHATHISTORY LATEST #foo * 10"
+	if r := expectMsg(t, conn1); r != ":foohost FAIL CHATHISTORY MESSAGE_ERROR LATEST :Messages history is not kept\r\n" {
+		t.Fatal("rejected CHATHISTORY", r)
+	}
+	conn1.inbound <- "CHATHISTORY FOO"
+	if r := expectMsg(t, conn1); r != ":foohost FAIL CHATHISTORY INVALID_PARAMS FOO :Unknown subcommand\r\n" {
+		t.Fatal("unknown CHATHISTORY subcommand", r)
+	}
+	conn1.inbound <- "CHATHISTORY"
+	if r := expectMsg(t, conn1); r != ":foohost FAIL CHATHISTORY NEED_MORE_PARAMS :Missing parameters\r\n" {
+		t.Fatal("CHATHISTORY without parameters", r)
+	}
+	conn2.inbound <- "CHATHISTORY LATEST #foo * 10"
+	expectNumeric(t, conn2, "421")
+
+	conn1.inbound <- "SETNAME :"
+	if r := expectMsg(t, conn1); r != ":foohost FAIL SETNAME INVALID_REALNAME :Realname is empty\r\n" {
+		t.Fatal("empty SETNAME", r)
+	}
+	conn2.inbound <- "SETNAME :"
+	expectNumeric(t, conn2, "461")
+
+	conn1.inbound <- "OPER admin secret"
+	expectNumeric(t, conn1, "381")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn1, "#bar")
+	conn1.inbound <- "RENAME #foo #BAR"
+	if r := expectMsg(t, conn1); r != ":foohost FAIL RENAME CHANNEL_NAME_IN_USE #foo #BAR :Channel name is already in use\r\n" {
+		t.Fatal("RENAME to existing channel", r)
+	}
+}
+
+func TestWhoMask(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn1.addr = TestingAddr("10.1.2.3:12345")
+	client1 := NewClient("foohost", conn1)
+	go client1.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 7; i++ {
+		expectMsg(t, conn1)
+	}
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	_, conn3 := registerClient(t, daemon, events, "nick3", "foo3")
+	conn3.inbound <- "MODE nick3 +i"
+	expectMsg(t, conn3)
+
+	for _, query := range []struct {
+		mask    string
+		replies []string
+	}{
+		{"NICK2", []string{"352 nick1 * foo2 someclient foohost nick2 H :0 Long nick2"}},
+		{"10.1.*", []string{"352 nick1 * foo1 10.1.2.3 foohost nick1 H :0 Long name1"}},
+		{"nick*", []string{
+			"352 nick1 * foo1 10.1.2.3 foohost nick1 H :0 Long name1",
+			"352 nick1 * foo2 someclient foohost nick2 H :0 Long nick2",
+		}},
+		{"nobody", []string{}},
+	} {
+		conn1.inbound <- "WHO " + query.mask
+		for _, want := range append(query.replies, "315 nick1 "+query.mask+" :End of /WHO list") {
+			if r := expectMsg(t, conn1); r != ":foohost "+want+"\r\n" {
+				t.Fatal("WHO", query.mask, r)
+			}
+		}
+	}
+	conn3.inbound <- "WHO nick3"
+	expectNumeric(t, conn3, "352")
+	conn2.inbound <- "WHO #nonexistent"
+	expectNumeric(t, conn2, "403")
+}
+
+func TestAuditDirectMessage(t *testing.T) {
+	audit_sink := make(chan AuditEvent, 4)
+	daemon := NewDaemon("foohost", "", nil, nil)
+	daemon.AuditSink = audit_sink
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+
+	conn1.inbound <- "PRIVMSG nick2 :hello"
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@someclient PRIVMSG nick2 :hello\r\n" {
+		t.Fatal("direct message", r)
+	}
+	event := <-audit_sink
+	// sha256("hello")
+	digest := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if event.command != "PRIVMSG" || event.sender != "nick1!foo1@someclient" ||
+		event.recipient != "nick2!foo2@someclient" || event.digest != digest {
+		t.Fatal("direct message audit", event)
+	}
+	line := event.Format()
+	if !strings.HasSuffix(line, " PRIVMSG nick1!foo1@someclient nick2!foo2@someclient "+digest+"\n") ||
+		strings.Contains(line, "hello") {
+		t.Fatal("audit log line", line)
+	}
+}
+
+// Several clients concurrently send b.N events each to the daemon
+// through events queue of specified size
+func benchmarkEvents(b *testing.B, buffer int) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent, buffer)
+	done := make(chan struct{})
+	go func() {
+		daemon.Processor(events)
+		close(done)
+	}()
+	clients := make([]*Client, 8)
+	for i := range clients {
+		clients[i] = NewClient("foohost", NewTestingConn())
+		events <- ClientEvent{clients[i], EVENT_NEW, ""}
+	}
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			for i := 0; i < b.N; i++ {
+				client.EventSend(events, ClientEvent{client, EVENT_MSG, "PONG foohost"})
+			}
+			wg.Done()
+		}(client)
+	}
+	wg.Wait()
+	close(events)
+	<-done
+}
+
+func BenchmarkEventsUnbuffered(b *testing.B) {
+	benchmarkEvents(b, 0)
+}
+
+func BenchmarkEventsBuffered(b *testing.B) {
+	benchmarkEvents(b, 1024)
+}
+
+// Clients work over buffered events queue, and events are never
+// dropped when it is full: sending client waits instead
+func TestEventsBuffer(t *testing.T) {
+	daemon := NewDaemon("foohost", "", nil, nil)
+	events := make(chan ClientEvent, 4)
+	go daemon.Processor(events)
+	_, conn := registerClient(t, daemon, events, "nick1", "foo1")
+	conn.inbound <- strings.TrimSuffix(strings.Repeat("PING foo\r\n", 8), "\r\n")
+	for i := 0; i < 8; i++ {
+		if r := expectMsg(t, conn); r != ":foohost PONG foohost :foo\r\n" {
+			t.Fatal("PONG", i, r)
+		}
+	}
+
+	client := NewClient("foohost", NewTestingConn())
+	full := make(chan ClientEvent, 1)
+	client.EventSend(full, ClientEvent{client, EVENT_MSG, "first"})
+	sent := make(chan struct{})
+	go func() {
+		client.EventSend(full, ClientEvent{client, EVENT_MSG, "second"})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("event is sent to full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if event := <-full; event.text != "first" {
+		t.Fatal("first event", event)
+	}
+	<-sent
+	if event := <-full; event.text != "second" {
+		t.Fatal("event is dropped", event)
+	}
+}
@@ -18,27 +18,48 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	EVENT_NEW   = iota
-	EVENT_DEL   = iota
-	EVENT_MSG   = iota
-	EVENT_TOPIC = iota
-	EVENT_WHO   = iota
-	EVENT_MODE  = iota
-	FORMAT_MSG  = "[%s] <%s> %s\n"
-	FORMAT_META = "[%s] * %s %s\n"
+	EVENT_NEW      = iota
+	EVENT_DEL      = iota
+	EVENT_MSG      = iota
+	EVENT_TOPIC    = iota
+	EVENT_WHO      = iota
+	EVENT_MODE     = iota
+	EVENT_RENAME   = iota
+	EVENT_SHUTDOWN = iota
+	EVENT_QUIT     = iota
+	EVENT_DEBUG    = iota
+	EVENT_RELOAD   = iota
+	FORMAT_MSG     = "[%s] <%s> %s\n"
+	FORMAT_META    = "[%s] * %s %s\n"
+	FORMAT_JSON    = "json"
+	FORMAT_TIME    = time.RFC3339
+
+	LOG_FLUSH_PERIOD = time.Second
+	LOG_IDLE_TIMEOUT = time.Minute
 )
 
 // Client events going from each of client
-// They can be either NEW, DEL or unparsed MSG
+// They can be either NEW, DEL or unparsed MSG. SHUTDOWN one is sent
+// to daemon on termination signal, RELOAD on SIGHUP. QUIT is sent to
+// rooms to remove already announced quitted client. DEBUG asks room to
+// report its state.
 type ClientEvent struct {
 	client     *Client
 	event_type int
@@ -46,59 +67,287 @@ type ClientEvent struct {
 }
 
 func (m ClientEvent) String() string {
-	return string(m.event_type) + ": " + m.client.String() + ": " + m.text
+	return fmt.Sprintf("%d: %s: %s", m.event_type, m.client, m.text)
 }
 
 // Logging in-room events
 // Intended to tell when, where and who send a message or meta command
 type LogEvent struct {
-	where string
-	who   string
-	what  string
-	meta  bool
+	where    string
+	who      string
+	hostmask string
+	what     string
+	meta     bool
+}
+
+// Log event representation in FORMAT_JSON logs
+type LogRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Room      string    `json:"room"`
+	Nick      string    `json:"nick"`
+	Hostmask  string    `json:"hostmask"`
+	Kind      string    `json:"kind"`
+	Text      string    `json:"text"`
+}
+
+// Format event happened at specified time as a single log line. It is
+// either human readable FORMAT_MSG/FORMAT_META with time formatted
+// with timefmt layout (FORMAT_TIME if empty), or JSON object if
+// FORMAT_JSON format is requested.
+func (event LogEvent) Format(format, timefmt string, when time.Time) string {
+	if format == FORMAT_JSON {
+		record := LogRecord{when, event.where, event.who, event.hostmask, "message", event.what}
+		if event.meta {
+			record.Kind = "meta"
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			log.Println("Can not marshal log record", err)
+		}
+		return string(data) + "\n"
+	}
+	if timefmt == "" {
+		timefmt = FORMAT_TIME
+	}
+	if event.meta {
+		return fmt.Sprintf(FORMAT_META, when.Format(timefmt), event.who, event.what)
+	}
+	return fmt.Sprintf(FORMAT_MSG, when.Format(timefmt), event.who, event.what)
+}
+
+// Opened room's log file with buffered writes to it
+type LogFile struct {
+	name string
+	fd   *os.File
+	buf  *bufio.Writer
+	used time.Time
+}
+
+// Write buffered data to the file
+func (f *LogFile) Flush() {
+	if err := f.buf.Flush(); err != nil {
+		log.Println("Error writing to logfile", f.name, err)
+	}
+}
+
+// Flush buffered data and close the file
+func (f *LogFile) Close() {
+	f.Flush()
+	if err := f.fd.Close(); err != nil {
+		log.Println("Error closing logfile", f.name, err)
+	}
 }
 
 // Logging events logger itself
-// Each room's events are written to separate file in logdir
+// Each room's events are written to separate directory in logdir, to
+// the file named after the current date, like "#room/2006-01-02.log"
 // Events include messages, topic and keys changes, joining and leaving
-func Logger(logdir string, events <-chan LogEvent) {
+// Format is either FORMAT_JSON or empty for human readable lines with
+// timefmt layout timestamps
+// Log files are kept opened and their writes are buffered: they are
+// flushed every LOG_FLUSH_PERIOD and closed after LOG_IDLE_TIMEOUT of
+// inactivity or date change. All of them are flushed and closed when
+// events channel is closed.
+func Logger(logdir, format, timefmt string, events <-chan LogEvent) {
 	mode := os.O_CREATE | os.O_WRONLY | os.O_APPEND
 	perm := os.FileMode(0660)
-	var format string
-	for event := range events {
-		logfile := path.Join(logdir, event.where)
-		fd, err := os.OpenFile(logfile, mode, perm)
-		if err != nil {
-			log.Println("Can not open logfile", logfile, err)
-			continue
+	files := make(map[string]*LogFile)
+	ticker := time.NewTicker(LOG_FLUSH_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				for _, f := range files {
+					f.Close()
+				}
+				return
+			}
+			now := time.Now()
+			roomdir := path.Join(logdir, event.where)
+			logfile := path.Join(roomdir, now.Format("2006-01-02")+".log")
+			f := files[event.where]
+			if f != nil && f.name != logfile {
+				f.Close()
+				f = nil
+			}
+			if f == nil {
+				delete(files, event.where)
+				if err := os.MkdirAll(roomdir, os.FileMode(0770)); err != nil {
+					log.Println("Can not create log directory", roomdir, err)
+					continue
+				}
+				fd, err := os.OpenFile(logfile, mode, perm)
+				if err != nil {
+					log.Println("Can not open logfile", logfile, err)
+					continue
+				}
+				f = &LogFile{name: logfile, fd: fd, buf: bufio.NewWriter(fd)}
+				files[event.where] = f
+			}
+			f.used = now
+			if _, err := f.buf.WriteString(event.Format(format, timefmt, now)); err != nil {
+				log.Println("Error writing to logfile", logfile, err)
+			}
+		case now := <-ticker.C:
+			for where, f := range files {
+				if now.Sub(f.used) > LOG_IDLE_TIMEOUT {
+					f.Close()
+					delete(files, where)
+				} else {
+					f.Flush()
+				}
+			}
 		}
-		if event.meta {
-			format = FORMAT_META
-		} else {
-			format = FORMAT_MSG
-		}
-		_, err = fd.WriteString(fmt.Sprintf(format, time.Now(), event.who, event.what))
-		fd.Close()
-		if err != nil {
-			log.Println("Error writing to logfile", logfile, err)
+	}
+}
+
+// Audited PRIVMSG or NOTICE delivery to either client or room. Only
+// SHA-256 digest of the text is kept, not the text itself
+type AuditEvent struct {
+	when      time.Time
+	command   string
+	sender    string
+	recipient string
+	digest    string
+}
+
+func NewAuditEvent(command, sender, recipient, text string) AuditEvent {
+	digest := sha256.Sum256([]byte(text))
+	return AuditEvent{time.Now(), command, sender, recipient, hex.EncodeToString(digest[:])}
+}
+
+// Audit log line: "time command sender recipient digest"
+func (event AuditEvent) Format() string {
+	return fmt.Sprintf("%s %s %s %s %s\n", event.when.UTC().Format(time.RFC3339Nano),
+		event.command, event.sender, event.recipient, event.digest)
+}
+
+// Audit events logger writes each delivery to w immediately, without
+// buffering, until events channel is closed
+func AuditLogger(w io.Writer, events <-chan AuditEvent) {
+	for event := range events {
+		if _, err := io.WriteString(w, event.Format()); err != nil {
+			log.Println("Error writing to audit log", err)
 		}
 	}
 }
 
 type StateEvent struct {
-	where string
-	topic string
-	key   string
+	where       string
+	topic       string
+	topic_by    string
+	topic_time  time.Time
+	created     time.Time
+	key         string
+	bans        []string
+	excepts     []string
+	op_accounts []string
+	removed     bool
+}
+
+// Room state representation in state files
+type StateRecord struct {
+	Topic     string   `json:"topic"`
+	TopicBy   string   `json:"topic_by,omitempty"`
+	TopicTime int64    `json:"topic_time,omitempty"`
+	Created   int64    `json:"created,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Bans      []string `json:"bans,omitempty"`
+	Excepts   []string `json:"excepts,omitempty"`
+	// Accounts of operators, given operator status back on join
+	OpAccounts []string `json:"op_accounts,omitempty"`
+}
+
+func (event StateEvent) Record() StateRecord {
+	record := StateRecord{
+		Topic:      event.topic,
+		Created:    event.created.Unix(),
+		Key:        event.key,
+		Bans:       event.bans,
+		Excepts:    event.excepts,
+		OpAccounts: event.op_accounts,
+	}
+	if event.topic_by != "" {
+		record.TopicBy = event.topic_by
+		record.TopicTime = event.topic_time.Unix()
+	}
+	return record
+}
+
+var (
+	STATE_UNESCAPER = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+)
+
+// Parse state file contents: either JSON StateRecord, or legacy lines
+// of escaped topic, key, space separated bans, topic setter with its
+// unix time, room creation unix time and space separated ban
+// exceptions. Operators accounts are kept only in JSON ones. Missing
+// fields are left empty, unknown JSON fields are
+// ignored. Malformed JSON and invalid key are errors.
+func StateParse(buf []byte) (StateRecord, error) {
+	var record StateRecord
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{")) {
+		if err := json.Unmarshal(buf, &record); err != nil {
+			return record, err
+		}
+	} else {
+		contents := strings.Split(string(buf), "\n")
+		if len(contents) < 2 {
+			return record, fmt.Errorf("truncated state %q", buf)
+		}
+		record.Topic = STATE_UNESCAPER.Replace(contents[0])
+		record.Key = contents[1]
+		if len(contents) > 2 {
+			record.Bans = strings.Fields(contents[2])
+		}
+		if len(contents) > 3 {
+			if topic_by := strings.Fields(contents[3]); len(topic_by) == 2 {
+				if unix, err := strconv.ParseInt(topic_by[1], 10, 64); err == nil {
+					record.TopicBy = topic_by[0]
+					record.TopicTime = unix
+				}
+			}
+		}
+		if len(contents) > 4 {
+			if unix, err := strconv.ParseInt(contents[4], 10, 64); err == nil {
+				record.Created = unix
+			}
+		}
+		if len(contents) > 5 {
+			record.Excepts = strings.Fields(contents[5])
+		}
+	}
+	if record.Key != "" && !KeyValid(record.Key) {
+		return record, fmt.Errorf("invalid key %q", record.Key)
+	}
+	return record, nil
 }
 
 // Room state events saver
-// Room states shows that either topic or key has been changed
-// Each room's state is written to separate file in statedir
+// Room states shows that either topic, key or bans have been changed
+// Each room's state is written to separate file in statedir as JSON
+// StateRecord. It is written to temporary ".#room" file first and then
+// renamed, so crash can not leave truncated state.
+// Removed room's state file is deleted
 func StateKeeper(statedir string, events <-chan StateEvent) {
 	for event := range events {
 		fn := path.Join(statedir, event.where)
-		data := event.topic + "\n" + event.key + "\n"
-		err := ioutil.WriteFile(fn, []byte(data), os.FileMode(0660))
+		if event.removed {
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				log.Printf("Can not remove statefile %s: %v", fn, err)
+			}
+			continue
+		}
+		data, err := json.Marshal(event.Record())
+		if err != nil {
+			log.Printf("Can not marshal state %s: %v", fn, err)
+			continue
+		}
+		tmp := path.Join(statedir, "."+event.where)
+		if err = ioutil.WriteFile(tmp, append(data, '\n'), os.FileMode(0660)); err == nil {
+			err = os.Rename(tmp, fn)
+		}
 		if err != nil {
 			log.Printf("Can not write statefile %s: %v", fn, err)
 		}
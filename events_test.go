@@ -0,0 +1,174 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFormat(t *testing.T) {
+	when := time.Date(2014, time.June, 9, 12, 0, 0, 0, time.UTC)
+	event := LogEvent{"#foo", "nick1", "nick1!foo1@someclient", "hello", false}
+
+	if l := event.Format("", "", when); l != "[2014-06-09T12:00:00Z] <nick1> hello\n" {
+		t.Fatal("plain text message log line", l)
+	}
+	if l := event.Format("", "2006-01-02 15:04", when); l != "[2014-06-09 12:00] <nick1> hello\n" {
+		t.Fatal("plain text message log line with custom time format", l)
+	}
+	event.meta = true
+	if l := event.Format("", "", when); l != "[2014-06-09T12:00:00Z] * nick1 hello\n" {
+		t.Fatal("plain text meta log line", l)
+	}
+
+	l := event.Format(FORMAT_JSON, "", when)
+	if !strings.HasSuffix(l, "}\n") || strings.Count(l, "\n") != 1 {
+		t.Fatal("JSON log line", l)
+	}
+	var record LogRecord
+	if err := json.Unmarshal([]byte(l), &record); err != nil {
+		t.Fatal("JSON log line parsing", err)
+	}
+	if !record.Timestamp.Equal(when) || (record.Room != "#foo") || (record.Nick != "nick1") ||
+		(record.Hostmask != "nick1!foo1@someclient") || (record.Kind != "meta") || (record.Text != "hello") {
+		t.Fatal("JSON log record", record)
+	}
+	event.meta = false
+	if l := event.Format(FORMAT_JSON, "", when); !strings.Contains(l, `"kind":"message"`) {
+		t.Fatal("JSON message log line", l)
+	}
+}
+
+func TestStateTopicEscaping(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "states")
+	if err != nil {
+		t.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(statedir)
+
+	topic := "multi\nline: topic \\n with\r\nbreaks"
+	events := make(chan StateEvent, 1)
+	events <- StateEvent{where: "#foo", topic: topic, topic_by: "nick!user@host", topic_time: time.Unix(1234567890, 0), created: time.Unix(1234567000, 0), key: "key", bans: []string{"*!*@badhost"}, excepts: []string{"nick!*@*"}}
+	close(events)
+	StateKeeper(statedir, events)
+	if files, _ := ioutil.ReadDir(statedir); len(files) != 1 {
+		t.Fatal("temporary state file is left", files)
+	}
+	if buf, _ := ioutil.ReadFile(path.Join(statedir, "#foo")); !strings.HasPrefix(string(buf), `{"topic":"multi\nline`) {
+		t.Fatal("JSON state file", string(buf))
+	}
+
+	daemon := NewDaemon("foohost", "", nil, nil)
+	if err := daemon.StatesLoad(statedir); err != nil {
+		t.Fatal("loading states", err)
+	}
+	r := daemon.rooms["#foo"]
+	if (r == nil) || (r.topic != topic) || (r.key != "key") || (len(r.bans) != 1) {
+		t.Fatal("escaped topic state", r)
+	}
+	if (r.topic_by != "nick!user@host") || (r.topic_time.Unix() != 1234567890) {
+		t.Fatal("topic setter state", r.topic_by, r.topic_time)
+	}
+	if r.created.Unix() != 1234567000 {
+		t.Fatal("creation time state", r.created)
+	}
+	if (len(r.excepts) != 1) || (r.excepts[0] != "nick!*@*") {
+		t.Fatal("ban exceptions state", r.excepts)
+	}
+}
+
+func TestLoggerRotation(t *testing.T) {
+	logdir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(logdir)
+
+	before := time.Now().Format("2006-01-02")
+	events := make(chan LogEvent, 2)
+	events <- LogEvent{"#foo", "nick", "nick!user@host", "hello", false}
+	events <- LogEvent{"#foo", "nick", "nick!user@host", "joined", true}
+	close(events)
+	Logger(logdir, "", "", events)
+	after := time.Now().Format("2006-01-02")
+
+	buf, err := ioutil.ReadFile(path.Join(logdir, "#foo", before+".log"))
+	if err != nil && before != after {
+		buf, err = ioutil.ReadFile(path.Join(logdir, "#foo", after+".log"))
+	}
+	if err != nil {
+		t.Fatal("dated log file", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "<nick> hello") || !strings.HasSuffix(lines[1], "* nick joined") {
+		t.Fatal("dated log file contents", lines)
+	}
+}
+
+// Previous Logger implementation, reopening log file for every event
+func loggerReopening(logdir string, events <-chan LogEvent) {
+	for event := range events {
+		now := time.Now()
+		roomdir := path.Join(logdir, event.where)
+		os.MkdirAll(roomdir, os.FileMode(0770))
+		logfile := path.Join(roomdir, now.Format("2006-01-02")+".log")
+		fd, err := os.OpenFile(logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(0660))
+		if err != nil {
+			continue
+		}
+		fd.WriteString(event.Format("", "", now))
+		fd.Close()
+	}
+}
+
+func benchmarkLogger(b *testing.B, logger func(string, <-chan LogEvent)) {
+	logdir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		b.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(logdir)
+	events := make(chan LogEvent, 64)
+	done := make(chan struct{})
+	go func() {
+		logger(logdir, events)
+		close(done)
+	}()
+	rooms := []string{"#foo", "#bar", "#baz"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		events <- LogEvent{rooms[i%len(rooms)], "nick", "nick!user@host", "hello", false}
+	}
+	close(events)
+	<-done
+}
+
+func BenchmarkLogger(b *testing.B) {
+	benchmarkLogger(b, func(logdir string, events <-chan LogEvent) {
+		Logger(logdir, "", "", events)
+	})
+}
+
+func BenchmarkLoggerReopening(b *testing.B) {
+	benchmarkLogger(b, loggerReopening)
+}
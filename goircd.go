@@ -20,115 +20,327 @@ package main
 import (
 	"crypto/tls"
 	"flag"
-	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"path"
-	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	hostname = flag.String("hostname", "localhost", "Hostname")
-	bind     = flag.String("bind", ":6667", "Address to bind to")
+	network  = flag.String("network", "", "Network name shown in 005 reply, hostname by default")
+	nicklen  = flag.Int("nicklen", NICKNAME_LEN, "Max nickname length.")
 	motd     = flag.String("motd", "", "Path to MOTD file")
 	logdir   = flag.String("logdir", "", "Absolute path to directory for logs")
 	statedir = flag.String("statedir", "", "Absolute path to directory for states")
+	opers    = flag.String("opers", "", "Path to file with IRC operators credentials")
+	accounts = flag.String("accounts", "", "Path to file with SASL accounts credentials")
+	auditLog = flag.String("audit-log", "", "Path to file to log every PRIVMSG/NOTICE delivery to")
 
-	ssl     = flag.Bool("ssl", false, "Use SSL only.")
+	ssl     = flag.Bool("ssl", false, "Use SSL only for -bind addresses.")
 	sslKey  = flag.String("ssl_key", "", "SSL keyfile.")
 	sslCert = flag.String("ssl_cert", "", "SSL certificate.")
 
 	verbose = flag.Bool("v", false, "Enable verbose logging.")
+
+	adminName  = flag.String("admin_name", "", "Server administrator's name.")
+	adminLoc   = flag.String("admin_loc", "", "Server's location.")
+	adminEmail = flag.String("admin_email", "", "Server administrator's email.")
+
+	logformat          = flag.String("logformat", "", "Logs format: either empty for plain text or json.")
+	logtimefmt         = flag.String("logtimefmt", FORMAT_TIME, "Timestamps layout in plain text logs, in Go's reference time notation.")
+	operOnlyChancreate = flag.Bool("oper-only-chancreate", false, "Only IRC operators may create channels.")
+	badNicks           = flag.String("badnicks", "", "Comma-separated glob patterns of forbidden nicknames.")
+	badChans           = flag.String("badchans", "", "Comma-separated glob patterns of forbidden channel names.")
+	defaultUmodes      = flag.String("default-umodes", "", "User modes set for clients after registration, like +i.")
+	truncateLongLines  = flag.Bool("truncate-long-lines", false, "Process too long messages truncated instead of dropping them.")
+	connClasses        = flag.String("conn-classes", "", "Path to file with connection classes limits.")
+	vhostsFile         = flag.String("vhosts", "", "Path to file with SNI virtual hosts certificates and network names.")
+	awayWindow         = flag.Duration("away-window", time.Minute, "Minimal interval between repeated away replies about the same user.")
+	regTimeout         = flag.Duration("reg-timeout", REG_TIMEOUT, "Disconnect clients not registered during that time, zero disables.")
+	reserveNicks       = flag.Bool("reserve-nicks", false, "Nicknames equal to -accounts names require authentication.")
+	maxUnregistered    = flag.Int("max-unregistered", 0, "Maximal number of concurrent unregistered connections, zero disables.")
+	autoAway           = flag.Duration("auto-away", 0, "Mark clients idle for that long as away, zero disables.")
+	strictISupport     = flag.Bool("strict-isupport", false, "Refuse to start if advertised ISUPPORT tokens disagree with implemented features.")
+	ctcpVersion        = flag.String("ctcp-version", VERSION, "Reply to CTCP VERSION sent to the server.")
+	ctcpSource         = flag.String("ctcp-source", "", "Reply to CTCP SOURCE sent to the server, empty disables.")
+	defaultCharset     = flag.String("default-charset", "utf-8", "Charset clients are assumed to use: utf-8 or cp1251.")
+	resumeWindow       = flag.Duration("resume-window", 0, "Retain sessions of draft/resume capable clients for that long after disconnect, zero disables.")
+	connectRate        = flag.Int("connect-rate", 0, "Maximal number of connects per minute from single IP address, zero disables.")
+	chancreateRate     = flag.Int("chancreate-rate", 0, "Maximal number of channels client may create per minute, zero disables.")
+	maxChannels        = flag.Int("maxchannels", 0, "Maximal number of channels client may be member of, zero means unlimited.")
+	maxMessage         = flag.Int("max-message", 0, "Maximal length of channel message text in bytes, zero means unlimited.")
+	floodRate          = flag.Float64("flood-rate", 0, "Messages per second clients may send on average, zero disables flood control.")
+	floodBurst         = flag.Int("flood-burst", 10, "Messages clients may send at once with flood control.")
+	eventsBuffer       = flag.Int("events-buffer", 0, "Size of clients events queue to the daemon, zero means unbuffered.")
+	listBatch          = flag.Int("list-batch", 0, "Send LIST replies by batches of that many channels between other clients requests, zero disables.")
 )
 
+// Repeatable command line flag with addresses to bind to
+type addresses []string
+
+func (a *addresses) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *addresses) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+var (
+	binds    addresses
+	bindsSSL addresses
+	classes  []*ConnClass
+	charset  *Charset
+	limiter  *ConnLimiter
+	vhosts   []*VHost
+)
+
+func init() {
+	flag.Var(&binds, "bind", "Address to bind to, may be repeated (:6667 by default).")
+	flag.Var(&bindsSSL, "bind_ssl", "Address to bind SSL listener to, may be repeated.")
+}
+
+// Accept connections on listener and start processors for new clients
+func Accept(listener net.Listener, events chan<- ClientEvent) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error during accepting connection", err)
+			continue
+		}
+		if limiter != nil && !limiter.Allow(conn.RemoteAddr(), time.Now()) {
+			log.Println(conn.RemoteAddr(), "connects too often")
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte("ERROR :Too many connections" + CRLF))
+			conn.Close()
+			continue
+		}
+		client := NewClient(*hostname, conn)
+		client.truncate_long = *truncateLongLines
+		client.class = ConnClassLookup(classes, conn.RemoteAddr())
+		if client.class != nil && client.class.sendq > 0 {
+			client.conn.SendqSet(client.class.sendq)
+		}
+		client.charset = charset
+		if tlsconn, ok := conn.(*tls.Conn); ok && len(vhosts) > 0 {
+			go func() {
+				if vhost := VHostHandshake(tlsconn, vhosts); vhost != nil {
+					client.network = vhost.network
+				}
+				client.Processor(events)
+			}()
+			continue
+		}
+		go client.Processor(events)
+	}
+}
+
 func Run() {
-	var client *Client
-	events := make(chan ClientEvent)
+	events := make(chan ClientEvent, *eventsBuffer)
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
 
 	log_sink := make(chan LogEvent)
+	logs_done := make(chan struct{})
 	if *logdir == "" {
 		// Dummy logger
 		go func() {
 			for _ = range log_sink {
 			}
+			close(logs_done)
 		}()
 	} else {
 		if !path.IsAbs(*logdir) {
 			log.Fatalln("Need absolute path for logdir")
 			return
 		}
-		go Logger(*logdir, log_sink)
+		if (*logformat != "") && (*logformat != FORMAT_JSON) {
+			log.Fatalln("Unknown logformat", *logformat)
+		}
+		go func() {
+			Logger(*logdir, *logformat, *logtimefmt, log_sink)
+			close(logs_done)
+		}()
 		log.Println(*logdir, "logger initialized")
 	}
 
+	var audit_sink chan AuditEvent
+	audits_done := make(chan struct{})
+	if *auditLog != "" {
+		fd, err := os.OpenFile(*auditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(0600))
+		if err != nil {
+			log.Fatalln("Can not open audit log", err)
+		}
+		audit_sink = make(chan AuditEvent)
+		go func() {
+			AuditLogger(fd, audit_sink)
+			fd.Close()
+			close(audits_done)
+		}()
+		log.Println(*auditLog, "audit logger initialized")
+	} else {
+		close(audits_done)
+	}
+
 	state_sink := make(chan StateEvent)
 	daemon := NewDaemon(*hostname, *motd, log_sink, state_sink)
+	daemon.AuditSink = audit_sink
 	daemon.Verbose = *verbose
+	daemon.OperOnlyChancreate = *operOnlyChancreate
+	daemon.AwayWindow = *awayWindow
+	daemon.AutoAway = *autoAway
+	daemon.RegTimeout = *regTimeout
+	daemon.MaxUnregistered = *maxUnregistered
+	daemon.ReserveNicks = *reserveNicks
+	daemon.ResumeWindow = *resumeWindow
+	daemon.CtcpVersion = *ctcpVersion
+	daemon.CtcpSource = *ctcpSource
+	daemon.ListBatch = *listBatch
+	daemon.FloodRate = *floodRate
+	daemon.FloodBurst = *floodBurst
+	daemon.ChancreateRate = *chancreateRate
+	daemon.MaxChannels = *maxChannels
+	daemon.MaxMessage = *maxMessage
+	if *network != "" {
+		daemon.Network = *network
+	}
+	daemon.AdminName = *adminName
+	daemon.AdminLoc = *adminLoc
+	daemon.AdminEmail = *adminEmail
+	daemon.DefaultUmodes = *defaultUmodes
+	if *nicklen < 1 {
+		log.Fatalln("Invalid nickname length", *nicklen)
+	}
+	daemon.NicknameLen = *nicklen
+	for _, problem := range daemon.validateISupport() {
+		if *strictISupport {
+			log.Fatalln("ISUPPORT self-check failed:", problem)
+		}
+		log.Println("ISUPPORT self-check warning:", problem)
+	}
+	daemon.OpersFile = *opers
+	daemon.AccountsFile = *accounts
+	if err := daemon.Rehash(); err != nil {
+		log.Fatalln("Can not load configuration", err)
+	}
+	if *connClasses != "" {
+		var err error
+		if classes, err = ReadConnClasses(*connClasses); err != nil {
+			log.Fatalln("Can not read connection classes file", err)
+		}
+	}
+	if *vhostsFile != "" {
+		var err error
+		if vhosts, err = ReadVHosts(*vhostsFile); err != nil {
+			log.Fatalln("Can not read virtual hosts file", err)
+		}
+	}
+	if *connectRate > 0 {
+		limiter = NewConnLimiter(*connectRate, time.Minute)
+	}
+	var found bool
+	if charset, found = CharsetLookup(*defaultCharset); !found {
+		log.Fatalln("Unknown default charset", *defaultCharset)
+	}
+	if *badNicks != "" {
+		daemon.BadNicks = strings.Split(*badNicks, ",")
+	}
+	if *badChans != "" {
+		daemon.BadChans = strings.Split(*badChans, ",")
+	}
+	states_done := make(chan struct{})
 	if *statedir == "" {
 		// Dummy statekeeper
 		go func() {
 			for _ = range state_sink {
 			}
+			close(states_done)
 		}()
 	} else {
 		if !path.IsAbs(*statedir) {
 			log.Fatalln("Need absolute path for statedir")
 		}
-		states, err := filepath.Glob(path.Join(*statedir, "#*"))
-		if err != nil {
+		// States are JSON StateRecord files, one per room, holding
+		// topic, its setter and time, creation time, key, bans,
+		// exceptions and accounts of operators given +o. Older line
+		// based states are loaded too. Loaded rooms are registered
+		// before any client connects, and remembered operators get
+		// their status back on join after restart
+		if err := daemon.StatesLoad(*statedir); err != nil {
 			log.Fatalln("Can not read statedir", err)
 		}
-		for _, state := range states {
-			buf, err := ioutil.ReadFile(state)
-			if err != nil {
-				log.Fatalf("Can not read state %s: %v", state, err)
-			}
-			room, _ := daemon.RoomRegister(path.Base(state))
-			contents := strings.Split(string(buf), "\n")
-			if len(contents) < 2 {
-				log.Printf("State corrupted for %s: %q", room.name, contents)
-			} else {
-				room.topic = contents[0]
-				room.key = contents[1]
-				log.Println("Loaded state for room", room.name)
-			}
-		}
-		go StateKeeper(*statedir, state_sink)
+		go func() {
+			StateKeeper(*statedir, state_sink)
+			close(states_done)
+		}()
 		log.Println(*statedir, "statekeeper initialized")
 	}
 
-	var listener net.Listener
+	if len(binds) == 0 && len(bindsSSL) == 0 {
+		binds = addresses{":6667"}
+	}
 	if *ssl {
-		cert, err := tls.LoadX509KeyPair(*sslCert, *sslKey)
+		bindsSSL = append(bindsSSL, binds...)
+		binds = nil
+	}
+	listeners := 0
+	for _, addr := range binds {
+		listener, err := net.Listen("tcp", addr)
 		if err != nil {
-			log.Fatalf("Could not load SSL keys from %s and %s: %s", *sslCert, *sslKey, err)
+			log.Printf("Can not listen on %s: %v", addr, err)
+			continue
 		}
-		config := tls.Config{Certificates: []tls.Certificate{cert}}
-		listener, err = tls.Listen("tcp", *bind, &config)
+		log.Println("Listening on", addr)
+		go Accept(listener, events)
+		listeners++
+	}
+	if len(bindsSSL) > 0 {
+		cert, err := tls.LoadX509KeyPair(*sslCert, *sslKey)
 		if err != nil {
-			log.Fatalf("Can not listen on %s: %v", *bind, err)
+			log.Fatalf("Could not load SSL keys from %s and %s: %s", *sslCert, *sslKey, err)
 		}
-	} else {
-		var err error
-		listener, err = net.Listen("tcp", *bind)
-		if err != nil {
-			log.Fatalf("Can not listen on %s: %v", *bind, err)
+		config := VHostsTLSConfig(vhosts, cert)
+		for _, addr := range bindsSSL {
+			listener, err := tls.Listen("tcp", addr, config)
+			if err != nil {
+				log.Printf("Can not listen on %s: %v", addr, err)
+				continue
+			}
+			log.Println("Listening with SSL on", addr)
+			go Accept(listener, events)
+			listeners++
 		}
 	}
-	log.Println("Listening on", *bind)
-
-	go daemon.Processor(events)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Error during accepting connection", err)
-			continue
+	if listeners == 0 {
+		log.Fatalln("No listeners were started")
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			log.Println("Got signal", sig)
+			if sig == syscall.SIGHUP {
+				events <- ClientEvent{nil, EVENT_RELOAD, ""}
+				continue
+			}
+			events <- ClientEvent{nil, EVENT_SHUTDOWN, ""}
+			return
 		}
-		client = NewClient(*hostname, conn)
-		go client.Processor(events)
+	}()
+	daemon.Processor(events)
+	close(log_sink)
+	<-logs_done
+	if audit_sink != nil {
+		close(audit_sink)
 	}
+	<-audits_done
+	<-states_done
+	log.Println("Shutdown")
 }
 
 func main() {
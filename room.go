@@ -22,36 +22,97 @@ import (
 	"log"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CHANNEL_MODES = "Rbekmnopsv"
+	LIST_MODES    = "be"
+	// Members statuses modes and their nickname prefixes, by rank
+	PREFIX_MODES   = "ov"
+	PREFIX_SYMBOLS = "@+"
+
+	ROOM_NAME_LEN = 200 // Max room's name length without "#" prefix
+
+	LIST_MAX       = 50  // Max number of entries in each of +b/+e lists
+	MASK_LEN       = 128 // Max length of +b/+e mask
+	MASK_WILDCARDS = 8   // Max number of "*" in +b/+e mask
 )
 
 var (
-	RE_ROOM = regexp.MustCompile("^#[^\x00\x07\x0a\x0d ,:/]{1,200}$")
+	RE_ROOM = regexp.MustCompile(fmt.Sprintf("^#[^\x00\x07\x0a\x0d ,:/]{1,%d}$", ROOM_NAME_LEN))
 )
 
-// Sanitize room's name. It can consist of 1 to 50 ASCII symbols
+// Check room's name. It can consist of 1 to ROOM_NAME_LEN symbols
 // with some exclusions. All room names will have "#" prefix.
 func RoomNameValid(name string) bool {
 	return RE_ROOM.MatchString(name)
 }
 
+// Check room's key: it must not contain spaces, commas and control
+// characters, that break MODE replies, JOIN keys lists and state file
+func KeyValid(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == ',' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Sanitize room's name to canonical "#" prefixed form: local "&"
+// prefix is replaced with it. Returns sanitized name and its validity.
+func RoomNameSanitize(name string) (string, bool) {
+	if strings.HasPrefix(name, "&") {
+		name = "#" + name[1:]
+	}
+	return name, RoomNameValid(name)
+}
+
 type Room struct {
+	sync.RWMutex
 	Verbose    bool
+	MaxMessage int
 	name       string
 	topic      string
+	topic_by   string
+	topic_time time.Time
 	key        string
-	members    map[*Client]bool
-	hostname   string
-	log_sink   chan<- LogEvent
-	state_sink chan<- StateEvent
+	moderated  bool
+	noexternal bool
+	secret     bool
+	private    bool
+	regonly    bool
+	bans       []string
+	excepts    []string
+	// Accounts of operators, given operator status back on join
+	op_accounts []string
+	members     map[*Client]bool
+	operators   map[*Client]bool
+	voiced      map[*Client]bool
+	hostname    string
+	created     time.Time
+	log_sink    chan<- LogEvent
+	state_sink  chan<- StateEvent
+	// Messages deliveries audit sink, if auditing is enabled
+	audit_sink chan<- AuditEvent
 }
 
 func NewRoom(hostname, name string, log_sink chan<- LogEvent, state_sink chan<- StateEvent) *Room {
 	room := Room{name: name}
 	room.members = make(map[*Client]bool)
+	room.operators = make(map[*Client]bool)
+	room.voiced = make(map[*Client]bool)
 	room.topic = ""
 	room.key = ""
 	room.hostname = hostname
+	room.created = time.Now()
 	room.log_sink = log_sink
 	room.state_sink = state_sink
 	return &room
@@ -62,7 +123,148 @@ func (room *Room) SendTopic(client *Client) {
 		client.ReplyNicknamed("331", room.name, "No topic is set")
 	} else {
 		client.ReplyNicknamed("332", room.name, room.topic)
+		if room.topic_by != "" {
+			client.ReplyNicknamed("333", room.name, room.topic_by, strconv.FormatInt(room.topic_time.Unix(), 10))
+		}
+	}
+}
+
+// Replace member with resumed client, keeping its statuses. Returns
+// false if it is not a member.
+func (room *Room) MemberReplace(old, client *Client) bool {
+	if _, found := room.members[old]; !found {
+		return false
+	}
+	delete(room.members, old)
+	room.members[client] = true
+	if room.operators[old] {
+		delete(room.operators, old)
+		room.operators[client] = true
+	}
+	if room.voiced[old] {
+		delete(room.voiced, old)
+		room.voiced[client] = true
+	}
+	return true
+}
+
+// Channel type flag for NAMES reply: "@" for secret, "*" for private
+// and "=" for public rooms.
+func (room *Room) NamesFlag() string {
+	if room.secret {
+		return "@"
+	}
+	if room.private {
+		return "*"
+	}
+	return "="
+}
+
+// Assemble room's current modes: flags string like "+mk" and
+// space-separated parameters of them in the same order.
+func (room *Room) modeString() (flags, params string) {
+	flags = "+"
+	var args []string
+	if room.regonly {
+		flags = flags + "R"
+	}
+	if room.moderated {
+		flags = flags + "m"
+	}
+	if room.noexternal {
+		flags = flags + "n"
+	}
+	if room.private {
+		flags = flags + "p"
+	}
+	if room.secret {
+		flags = flags + "s"
+	}
+	if room.key != "" {
+		flags = flags + "k"
+		args = append(args, room.key)
+	}
+	return flags, strings.Join(args, " ")
+}
+
+// Send NAMES reply. userhost-in-names capable client gets full
+// hostmasks instead of nicknames. Names are split among several 353
+// replies, so none of them exceeds MAX_LINE.
+func (room *Room) SendNames(client *Client) {
+	overhead := len(fmt.Sprintf(":%s 353 %s %s %s :", client.hostname, client.nickname, room.NamesFlag(), room.name)) + len(CRLF)
+	nicknames := []string{}
+	length := overhead
+	for _, member := range room.MembersSorted() {
+		name := room.Prefix(member, client) + member.nickname
+		if client.caps["userhost-in-names"] {
+			name = room.Prefix(member, client) + member.Hostmask()
+		}
+		if len(nicknames) > 0 && length+1+len(name) > MAX_LINE {
+			client.ReplyNicknamed("353", room.NamesFlag(), room.name, strings.Join(nicknames, " "))
+			nicknames = []string{}
+			length = overhead
+		}
+		if len(nicknames) > 0 {
+			length++
+		}
+		nicknames = append(nicknames, name)
+		length += len(name)
+	}
+	client.ReplyNicknamed("353", room.NamesFlag(), room.name, strings.Join(nicknames, " "))
+	client.ReplyNicknamed("366", room.name, "End of NAMES list")
+}
+
+func (room *Room) SendBans(client *Client) {
+	for _, ban := range room.bans {
+		client.ReplyNicknamed("367", room.name, ban)
 	}
+	client.ReplyNicknamed("368", room.name, "End of channel ban list")
+}
+
+func (room *Room) SendExcepts(client *Client) {
+	for _, except := range room.excepts {
+		client.ReplyNicknamed("348", room.name, except)
+	}
+	client.ReplyNicknamed("349", room.name, "End of channel exception list")
+}
+
+// Is MODE argument a query of list modes, like "b" or "+be". Unknown
+// modes are allowed there, but at least one list mode is required
+func ListModesQuery(modes string) bool {
+	if strings.HasPrefix(modes, "-") {
+		return false
+	}
+	modes = strings.TrimPrefix(modes, "+")
+	listed := false
+	for _, mode := range modes {
+		if strings.ContainsRune(LIST_MODES, mode) {
+			listed = true
+		} else if strings.ContainsRune(CHANNEL_MODES, mode) {
+			return false
+		}
+	}
+	return listed
+}
+
+// Is client banned by any of room's hostmask patterns. Each of client's
+// hostmasks is tested, and matching any exception overrides bans
+func (room *Room) Banned(client *Client) bool {
+	masks := client.Hostmasks()
+	for _, except := range room.excepts {
+		for _, mask := range masks {
+			if GlobMatch(except, mask) {
+				return false
+			}
+		}
+	}
+	for _, ban := range room.bans {
+		for _, mask := range masks {
+			if GlobMatch(ban, mask) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Send message to all room's subscribers, possibly excluding someone
@@ -75,99 +277,429 @@ func (room *Room) Broadcast(msg string, client_to_ignore ...*Client) {
 	}
 }
 
+// Find room's member by his nickname, case insensitively
+func (room *Room) Member(nickname string) *Client {
+	nickname = strings.ToLower(nickname)
+	for member := range room.members {
+		if strings.ToLower(member.nickname) == nickname {
+			return member
+		}
+	}
+	return nil
+}
+
+// Room's members sorted by their nicknames
+func (room *Room) MembersSorted() []*Client {
+	members := []*Client{}
+	for member := range room.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].nickname < members[j].nickname
+	})
+	return members
+}
+
+// Nickname prefix showing member's status to client with
+// PREFIX_SYMBOLS: "@" for operators, "+" for voiced ones and empty
+// string for everyone else. All of them are shown to multi-prefix
+// capable client, only the highest one otherwise.
+func (room *Room) Prefix(member, client *Client) string {
+	prefix := ""
+	for n, statuses := range []map[*Client]bool{room.operators, room.voiced} {
+		if statuses[member] {
+			prefix += PREFIX_SYMBOLS[n : n+1]
+		}
+	}
+	if len(prefix) > 1 && !client.caps["multi-prefix"] {
+		prefix = prefix[:1]
+	}
+	return prefix
+}
+
 func (room *Room) StateSave() {
-	room.state_sink <- StateEvent{room.name, room.topic, room.key}
+	room.state_sink <- StateEvent{
+		where:       room.name,
+		topic:       room.topic,
+		topic_by:    room.topic_by,
+		topic_time:  room.topic_time,
+		created:     room.created,
+		key:         room.key,
+		bans:        append([]string{}, room.bans...),
+		excepts:     append([]string{}, room.excepts...),
+		op_accounts: append([]string{}, room.op_accounts...),
+	}
 }
 
-func (room *Room) Processor(events <-chan ClientEvent) {
-	var client *Client
-	for event := range events {
-		client = event.client
-		switch event.event_type {
-		case EVENT_NEW:
-			room.members[client] = true
-			if room.Verbose {
-				log.Println(client, "joined", room.name)
-			}
+// Is account remembered as operator's one
+func (room *Room) OpAccount(account string) bool {
+	for _, a := range room.op_accounts {
+		if a == account {
+			return true
+		}
+	}
+	return false
+}
+
+// Remember or forget authenticated member's account as operator's one
+// on explicit MODE +o/-o. Anonymous members are never remembered.
+// Returns true if remembered accounts were changed.
+func (room *Room) OpAccountSet(member *Client, op bool) bool {
+	if member.account == "" || room.OpAccount(member.account) == op {
+		return false
+	}
+	if op {
+		room.op_accounts = append(room.op_accounts, member.account)
+		return true
+	}
+	for n, a := range room.op_accounts {
+		if a == member.account {
+			room.op_accounts = append(room.op_accounts[:n], room.op_accounts[n+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Process single room's event. Room's state is locked by Processor
+// during it.
+func (room *Room) Process(event ClientEvent) {
+	client := event.client
+	switch event.event_type {
+	case EVENT_NEW:
+		if client.quitted {
+			return
+		}
+		if len(room.members) == 0 {
+			room.operators[client] = true
+		}
+		room.members[client] = true
+		if room.Verbose {
+			log.Println(client, "joined", room.name)
+		}
+		room.SendTopic(client)
+		room.Broadcast(fmt.Sprintf(":%s JOIN %s", client.Hostmask(), room.name))
+		room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), "joined", true}
+		room.SendNames(client)
+		if !room.operators[client] && client.account != "" && room.OpAccount(client.account) {
+			room.operators[client] = true
+			room.Broadcast(fmt.Sprintf(":%s MODE %s +o %s", room.hostname, room.name, client.nickname))
+			room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), "got operator status back", true}
+		}
+	case EVENT_DEL:
+		if _, subscribed := room.members[client]; !subscribed {
+			client.ReplyNicknamed("442", room.name, "You are not on that channel")
+			return
+		}
+		msg := fmt.Sprintf(":%s PART %s", client.Hostmask(), room.name)
+		if event.text != "" {
+			msg += " :" + event.text
+		}
+		room.Broadcast(msg)
+		// The last operator leaving gives up the room
+		if room.operators[client] && len(room.operators) == 1 && room.OpAccountSet(client, false) {
+			room.StateSave()
+		}
+		delete(room.members, client)
+		delete(room.operators, client)
+		delete(room.voiced, client)
+		room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), "left", true}
+	case EVENT_DEBUG:
+		flags, params := room.modeString()
+		for _, line := range []string{
+			fmt.Sprintf("members: %d, operators: %d, voiced: %d", len(room.members), len(room.operators), len(room.voiced)),
+			strings.TrimSpace("modes: " + flags + " " + params),
+			fmt.Sprintf("bans: %d", len(room.bans)),
+			fmt.Sprintf("exceptions: %d", len(room.excepts)),
+			fmt.Sprintf("topic: %q", room.topic),
+			"created: " + room.created.Format(time.RFC1123),
+		} {
+			client.Reply(fmt.Sprintf("NOTICE %s :%s %s", client.nickname, room.name, line))
+		}
+	case EVENT_QUIT:
+		if _, subscribed := room.members[client]; !subscribed {
+			return
+		}
+		delete(room.members, client)
+		delete(room.operators, client)
+		delete(room.voiced, client)
+		room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), "quit: " + event.text, true}
+	case EVENT_TOPIC:
+		if _, subscribed := room.members[client]; !subscribed {
+			client.ReplyParts("442", room.name, "You are not on that channel")
+			return
+		}
+		if event.text == "" {
 			room.SendTopic(client)
-			room.Broadcast(fmt.Sprintf(":%s JOIN %s", client, room.name))
-			room.log_sink <- LogEvent{room.name, client.nickname, "joined", true}
-			nicknames := []string{}
-			for member := range room.members {
-				nicknames = append(nicknames, member.nickname)
+			return
+		}
+		room.topic = strings.TrimLeft(event.text, ":")
+		room.topic_by = client.Hostmask()
+		room.topic_time = time.Now()
+		msg := fmt.Sprintf(":%s TOPIC %s :%s", client.Hostmask(), room.name, room.topic)
+		room.Broadcast(msg)
+		room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), "set topic to " + room.topic, true}
+		room.StateSave()
+	case EVENT_WHO:
+		if _, member := room.members[client]; room.secret && !member {
+			// Secret room does not exist for non-members
+			client.ReplyNoChannel(event.text)
+			return
+		}
+		for _, m := range room.MembersSorted() {
+			client.ReplyNicknamed("352", room.name, m.username, m.Host(), room.hostname, m.nickname, m.WhoStatus()+room.Prefix(m, client), "0 "+m.realname)
+		}
+		client.ReplyNicknamed("315", room.name, "End of /WHO list")
+	case EVENT_MODE:
+		if event.text == "" {
+			flags, params := room.modeString()
+			if _, subscribed := room.members[client]; subscribed && params != "" {
+				flags = flags + " " + params
 			}
-			sort.Strings(nicknames)
-			client.ReplyNicknamed("353", "=", room.name, strings.Join(nicknames, " "))
-			client.ReplyNicknamed("366", room.name, "End of NAMES list")
-		case EVENT_DEL:
-			if _, subscribed := room.members[client]; !subscribed {
-				client.ReplyNicknamed("442", room.name, "You are not on that channel")
-				continue
+			client.Msg(fmt.Sprintf("324 %s %s %s", client.nickname, room.name, flags))
+			client.ReplyNicknamed("329", room.name, strconv.FormatInt(room.created.Unix(), 10))
+			return
+		}
+		cols := strings.Split(event.text, " ")
+		if (len(cols) == 1) && ListModesQuery(cols[0]) {
+			for _, mode := range strings.TrimPrefix(cols[0], "+") {
+				switch mode {
+				case 'b':
+					room.SendBans(client)
+				case 'e':
+					room.SendExcepts(client)
+				default:
+					client.ReplyNicknamed("472", string(mode), "is unknown mode char to me for "+room.name)
+				}
 			}
-			delete(room.members, client)
-			msg := fmt.Sprintf(":%s PART %s :%s", client, room.name, client.nickname)
-			go room.Broadcast(msg)
-			room.log_sink <- LogEvent{room.name, client.nickname, "left", true}
-		case EVENT_TOPIC:
+			return
+		}
+		switch cols[0] {
+		case "+k", "-k", "+m", "-m", "+o", "-o", "+v", "-v", "+b", "-b", "+e", "-e", "+s", "-s", "+p", "-p", "+n", "-n", "+R", "-R":
 			if _, subscribed := room.members[client]; !subscribed {
 				client.ReplyParts("442", room.name, "You are not on that channel")
-				continue
-			}
-			if event.text == "" {
-				go room.SendTopic(client)
-				continue
+				return
 			}
-			room.topic = strings.TrimLeft(event.text, ":")
-			msg := fmt.Sprintf(":%s TOPIC %s :%s", client, room.name, room.topic)
-			go room.Broadcast(msg)
-			room.log_sink <- LogEvent{room.name, client.nickname, "set topic to " + room.topic, true}
-			room.StateSave()
-		case EVENT_WHO:
-			for m := range room.members {
-				client.ReplyNicknamed("352", room.name, m.username, m.conn.RemoteAddr().String(), room.hostname, m.nickname, "H", "0 "+m.realname)
-			}
-			client.ReplyNicknamed("315", room.name, "End of /WHO list")
-		case EVENT_MODE:
-			if event.text == "" {
-				mode := "+"
-				if room.key != "" {
-					mode = mode + "k"
+		default:
+			flag := strings.TrimLeft(cols[0], "+-")
+			for _, c := range flag {
+				if !strings.ContainsRune(CHANNEL_MODES, c) {
+					flag = string(c)
+					break
 				}
-				client.Msg(fmt.Sprintf("324 %s %s %s", client.nickname, room.name, mode))
-				continue
 			}
-			if strings.HasPrefix(event.text, "-k") || strings.HasPrefix(event.text, "+k") {
-				if _, subscribed := room.members[client]; !subscribed {
-					client.ReplyParts("442", room.name, "You are not on that channel")
+			client.ReplyNicknamed("472", flag, "is unknown mode char to me for "+room.name)
+			return
+		}
+		if !room.operators[client] {
+			client.ReplyNicknamed("482", room.name, "You're not channel operator")
+			return
+		}
+		var msg string
+		var msg_log string
+		op_accounts_changed := false
+		switch cols[0] {
+		case "+k":
+			if len(cols) == 1 {
+				client.ReplyNotEnoughParameters("MODE")
+				return
+			}
+			if !KeyValid(cols[1]) {
+				client.ReplyNicknamed("525", room.name, "Key is not well-formed")
+				return
+			}
+			room.key = cols[1]
+			msg = fmt.Sprintf(":%s MODE %s +k %s", client.Hostmask(), room.name, room.key)
+			msg_log = "set channel key to " + room.key
+		case "-k":
+			room.key = ""
+			msg = fmt.Sprintf(":%s MODE %s -k", client.Hostmask(), room.name)
+			msg_log = "removed channel key"
+		case "+m", "-m":
+			room.moderated = cols[0] == "+m"
+			msg = fmt.Sprintf(":%s MODE %s %s", client.Hostmask(), room.name, cols[0])
+			if room.moderated {
+				msg_log = "set channel moderated"
+			} else {
+				msg_log = "removed channel moderation"
+			}
+		case "+n", "-n":
+			room.noexternal = cols[0] == "+n"
+			msg = fmt.Sprintf(":%s MODE %s %s", client.Hostmask(), room.name, cols[0])
+			if room.noexternal {
+				msg_log = "forbade external messages"
+			} else {
+				msg_log = "allowed external messages"
+			}
+		case "+s", "-s":
+			room.secret = cols[0] == "+s"
+			msg = fmt.Sprintf(":%s MODE %s %s", client.Hostmask(), room.name, cols[0])
+			if room.secret {
+				msg_log = "set channel secret"
+			} else {
+				msg_log = "removed channel secrecy"
+			}
+		case "+p", "-p":
+			room.private = cols[0] == "+p"
+			msg = fmt.Sprintf(":%s MODE %s %s", client.Hostmask(), room.name, cols[0])
+			if room.private {
+				msg_log = "set channel private"
+			} else {
+				msg_log = "removed channel privacy"
+			}
+		case "+R", "-R":
+			room.regonly = cols[0] == "+R"
+			msg = fmt.Sprintf(":%s MODE %s %s", client.Hostmask(), room.name, cols[0])
+			if room.regonly {
+				msg_log = "allowed only identified users"
+			} else {
+				msg_log = "allowed unidentified users"
+			}
+		case "+o", "-o", "+v", "-v":
+			if len(cols) == 1 {
+				client.ReplyNotEnoughParameters("MODE")
+				return
+			}
+			member := room.Member(cols[1])
+			if member == nil {
+				client.ReplyNicknamed("441", cols[1], room.name, "They aren't on that channel")
+				return
+			}
+			statuses := room.voiced
+			what := "voice"
+			if cols[0][1] == 'o' {
+				statuses = room.operators
+				what = "operator status"
+			}
+			if cols[0][1] == 'o' {
+				op_accounts_changed = room.OpAccountSet(member, cols[0][0] == '+')
+			}
+			if cols[0][0] == '+' {
+				statuses[member] = true
+				msg_log = "gave " + what + " to " + member.nickname
+			} else {
+				delete(statuses, member)
+				msg_log = "took " + what + " from " + member.nickname
+			}
+			msg = fmt.Sprintf(":%s MODE %s %s %s", client.Hostmask(), room.name, cols[0], member.nickname)
+		case "+b", "-b", "+e", "-e":
+			if len(cols) == 1 {
+				client.ReplyNotEnoughParameters("MODE")
+				return
+			}
+			list, what := &room.bans, "ban"
+			if cols[0][1] == 'e' {
+				list, what = &room.excepts, "exception"
+			}
+			adding := cols[0][0] == '+'
+			mask := cols[1]
+			listed := false
+			for n, entry := range *list {
+				if strings.ToLower(entry) != strings.ToLower(mask) {
 					continue
 				}
+				listed = true
+				if !adding {
+					mask = entry
+					*list = append((*list)[:n], (*list)[n+1:]...)
+				}
+				break
+			}
+			if listed == adding {
+				return
+			}
+			if adding && (len(mask) > MASK_LEN || strings.Count(mask, "*") > MASK_WILDCARDS) {
+				client.ReplyNicknamed("696", room.name, cols[0][1:], mask, "Mask is too long or complex")
+				return
+			}
+			if adding && len(*list) >= LIST_MAX {
+				client.ReplyNicknamed("478", room.name, cols[0][1:], "Channel list is full")
+				return
+			}
+			if adding {
+				*list = append(*list, mask)
+				msg_log = "set " + what + " on " + mask
 			} else {
-				client.ReplyNicknamed("472", event.text, "Unknown MODE flag")
+				msg_log = "removed " + what + " on " + mask
+			}
+			msg = fmt.Sprintf(":%s MODE %s %s %s", client.Hostmask(), room.name, cols[0], mask)
+		}
+		room.Broadcast(msg)
+		room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), msg_log, true}
+		switch cols[0] {
+		case "+k", "-k", "+b", "-b", "+e", "-e":
+			room.StateSave()
+		case "+o", "-o":
+			if op_accounts_changed {
+				room.StateSave()
+			}
+		}
+	case EVENT_RENAME:
+		cols := strings.SplitN(event.text, " ", 2)
+		name := room.name
+		room.name = cols[0]
+		reason := cols[1]
+		if reason == "" {
+			reason = "Channel renamed to " + room.name
+		}
+		if room.Verbose {
+			log.Println(client, "renamed", name, "to", room.name)
+		}
+		// Members without draft/channel-rename see leaving the old
+		// room and joining the new one
+		for member := range room.members {
+			if member.caps["draft/channel-rename"] {
+				member.Msg(fmt.Sprintf(":%s RENAME %s %s :%s", client.Hostmask(), name, room.name, reason))
 				continue
 			}
-			var msg string
-			var msg_log string
-			if strings.HasPrefix(event.text, "+k") {
-				cols := strings.Split(event.text, " ")
-				if len(cols) == 1 {
-					client.ReplyNotEnoughParameters("MODE")
-					continue
+			member.Msg(fmt.Sprintf(":%s PART %s :%s", member.Hostmask(), name, reason))
+			member.Msg(fmt.Sprintf(":%s JOIN %s", member.Hostmask(), room.name))
+			room.SendTopic(member)
+			room.SendNames(member)
+		}
+		room.log_sink <- LogEvent{name, client.nickname, client.Hostmask(), "renamed channel to " + room.name, true}
+		room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), "renamed channel from " + name, true}
+		room.state_sink <- StateEvent{where: name, removed: true}
+		room.StateSave()
+	case EVENT_MSG:
+		// Only members can send to room, whether it is +n or not
+		if _, subscribed := room.members[client]; !subscribed {
+			client.ReplyNicknamed("404", room.name, "Cannot send to channel")
+			return
+		}
+		if room.moderated && !room.operators[client] && !room.voiced[client] {
+			client.ReplyNicknamed("404", room.name, "Cannot send to channel")
+			return
+		}
+		sep := strings.Index(event.text, " ")
+		if event.text[:sep] == "TAGMSG" {
+			// Tags are relayed to message-tags capable members only
+			msg := fmt.Sprintf("@%s :%s TAGMSG %s", event.text[sep+1:], client.Hostmask(), room.name)
+			for member := range room.members {
+				if member != client && member.caps["message-tags"] {
+					member.Msg(msg)
 				}
-				room.key = cols[1]
-				msg = fmt.Sprintf(":%s MODE %s +k %s", client, room.name, room.key)
-				msg_log = "set channel key to " + room.key
-			} else if strings.HasPrefix(event.text, "-k") {
-				room.key = ""
-				msg = fmt.Sprintf(":%s MODE %s -k", client, room.name)
-				msg_log = "removed channel key"
-			}
-			go room.Broadcast(msg)
-			room.log_sink <- LogEvent{room.name, client.nickname, msg_log, true}
-			room.StateSave()
-		case EVENT_MSG:
-			sep := strings.Index(event.text, " ")
-			room.Broadcast(fmt.Sprintf(":%s %s %s :%s", client, event.text[:sep], room.name, event.text[sep+1:]), client)
-			room.log_sink <- LogEvent{room.name, client.nickname, event.text[sep+1:], false}
+			}
+			return
+		}
+		if room.MaxMessage > 0 && len(event.text)-sep-1 > room.MaxMessage {
+			client.ReplyNicknamed("404", room.name, "Cannot send to channel (message is too long)")
+			return
 		}
+		room.Broadcast(fmt.Sprintf(":%s %s %s :%s", client.Hostmask(), event.text[:sep], room.name, event.text[sep+1:]), client)
+		room.log_sink <- LogEvent{room.name, client.nickname, client.Hostmask(), event.text[sep+1:], false}
+		if room.audit_sink != nil {
+			room.audit_sink <- NewAuditEvent(event.text[:sep], client.Hostmask(), room.name, event.text[sep+1:])
+		}
+	}
+}
+
+// Room processor handles events one by one. Room's state is guarded
+// by its lock: readers outside of that goroutine must hold RLock.
+func (room *Room) Processor(events <-chan ClientEvent) {
+	for event := range events {
+		room.Lock()
+		room.Process(event)
+		room.Unlock()
 	}
 }
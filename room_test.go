@@ -1,8 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func no_nickchan(t *testing.T, c *TestingConn) {
@@ -39,7 +45,7 @@ func TestTwoUsers(t *testing.T) {
 
 	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
 	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 7; i++ {
 		<-conn1.outbound
 		<-conn2.outbound
 	}
@@ -60,6 +66,12 @@ func TestTwoUsers(t *testing.T) {
 	if r := <-conn1.outbound; r != ":foohost 312 nick1 nick2 foohost :foohost\r\n" {
 		t.Fatal("first WHOIS 312", r)
 	}
+	var idle, signon int64
+	r := <-conn1.outbound
+	if n, _ := fmt.Sscanf(r, ":foohost 317 nick1 nick2 %d %d :seconds idle, signon time\r\n", &idle, &signon); n != 2 ||
+		idle != 0 || time.Now().Unix()-signon > 5 || !strings.HasSuffix(r, ":seconds idle, signon time\r\n") {
+		t.Fatal("first WHOIS 317", r)
+	}
 	if r := <-conn1.outbound; r != ":foohost 319 nick1 nick2 :\r\n" {
 		t.Fatal("first WHOIS 319", r)
 	}
@@ -78,11 +90,16 @@ func TestTwoUsers(t *testing.T) {
 	no_chan(t, conn1)
 
 	conn1.inbound <- "JOIN #foo"
-	conn2.inbound <- "JOIN #foo"
 	for i := 0; i < 4; i++ {
 		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
 		<-conn2.outbound
 	}
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("second JOIN broadcast", r)
+	}
 	conn1.inbound <- "PRIVMSG nick2 Hello"
 	conn1.inbound <- "PRIVMSG #foo :world"
 	conn1.inbound <- "NOTICE #foo :world"
@@ -95,6 +112,14 @@ func TestTwoUsers(t *testing.T) {
 	if r := <-conn2.outbound; r != ":nick1!foo1@someclient NOTICE #foo :world\r\n" {
 		t.Fatal("third message", r)
 	}
+	conn1.inbound <- "PRIVMSG nick2 :::)"
+	conn1.inbound <- "PRIVMSG #foo :::)"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :::)\r\n" {
+		t.Fatal("message with leading colons", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG #foo :::)\r\n" {
+		t.Fatal("room message with leading colons", r)
+	}
 }
 
 func TestJoin(t *testing.T) {
@@ -108,7 +133,7 @@ func TestJoin(t *testing.T) {
 	go client.Processor(events)
 
 	conn.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 7; i++ {
 		<-conn.outbound
 	}
 
@@ -126,7 +151,7 @@ func TestJoin(t *testing.T) {
 	if r := <-conn.outbound; r != ":nick2!foo2@someclient JOIN #foo\r\n" {
 		t.Fatal("no JOIN message", r)
 	}
-	if r := <-conn.outbound; r != ":foohost 353 nick2 = #foo :nick2\r\n" {
+	if r := <-conn.outbound; r != ":foohost 353 nick2 = #foo :@nick2\r\n" {
 		t.Fatal("no NAMES list", r)
 	}
 	if r := <-conn.outbound; r != ":foohost 366 nick2 #foo :End of NAMES list\r\n" {
@@ -153,6 +178,14 @@ func TestJoin(t *testing.T) {
 		t.Fatal("invalid join log event #baz", r)
 	}
 
+	conn.inbound <- "JOIN #badenc bad\x01key"
+	if r := <-conn.outbound; r != ":foohost 525 nick2 #badenc :Key is not well-formed\r\n" {
+		t.Fatal("JOIN with invalid key", r)
+	}
+	if _, found := daemon.rooms["#badenc"]; found {
+		t.Fatal("room with invalid key is created")
+	}
+
 	conn.inbound <- "JOIN #barenc,#bazenc key1,key2"
 	for i := 0; i < 4*2; i++ {
 		<-conn.outbound
@@ -191,6 +224,9 @@ func TestJoin(t *testing.T) {
 	}
 
 	conn.inbound <- "PART #bazenc\r\nMODE #bazenc -k"
+	if r := <-conn.outbound; r != ":nick2!foo2@someclient PART #bazenc\r\n" {
+		t.Fatal("PART", r)
+	}
 	if r := <-conn.outbound; r != ":foohost 442 #bazenc :You are not on that channel\r\n" {
 		t.Fatal("not on that channel", r)
 	}
@@ -198,11 +234,23 @@ func TestJoin(t *testing.T) {
 		t.Fatal("left #bazenc log", r)
 	}
 
-	conn.inbound <- "MODE #barenc +b"
-	if r := <-conn.outbound; r != ":foohost 472 nick2 +b :Unknown MODE flag\r\n" {
+	conn.inbound <- "MODE #barenc +x"
+	if r := <-conn.outbound; r != ":foohost 472 nick2 x :is unknown mode char to me for #barenc\r\n" {
 		t.Fatal("unknown MODE flag", r)
 	}
 
+	conn.inbound <- "MODE #barenc +kz"
+	if r := <-conn.outbound; r != ":foohost 472 nick2 z :is unknown mode char to me for #barenc\r\n" {
+		t.Fatal("unknown MODE flag after known one", r)
+	}
+
+	for _, key := range []string{"bad,key", "bad\x01key", "bad\x7fkey"} {
+		conn.inbound <- "MODE #barenc +k " + key
+		if r := <-conn.outbound; r != ":foohost 525 nick2 #barenc :Key is not well-formed\r\n" {
+			t.Fatal("invalid +k MODE", r)
+		}
+	}
+
 	conn.inbound <- "MODE #barenc +k newkey"
 	if r := <-conn.outbound; r != ":nick2!foo2@someclient MODE #barenc +k newkey\r\n" {
 		t.Fatal("+k MODE setting", r)
@@ -213,6 +261,11 @@ func TestJoin(t *testing.T) {
 	if r := <-state_sink; (r.topic != "") || (r.where != "#barenc") || (r.key != "newkey") {
 		t.Fatal("set channel newkey state", r)
 	}
+	conn.inbound <- "MODE #barenc"
+	if r := <-conn.outbound; r != "324 nick2 #barenc +k newkey\r\n" {
+		t.Fatal("keyed MODE reply", r)
+	}
+	<-conn.outbound
 
 	conn.inbound <- "TOPIC #barenc :New topic"
 	if r := <-conn.outbound; r != ":nick2!foo2@someclient TOPIC #barenc :New topic\r\n" {
@@ -226,7 +279,7 @@ func TestJoin(t *testing.T) {
 	}
 
 	conn.inbound <- "WHO #barenc"
-	if r := <-conn.outbound; r != ":foohost 352 nick2 #barenc foo2 someclient foohost nick2 H :0 Long name2\r\n" {
+	if r := <-conn.outbound; r != ":foohost 352 nick2 #barenc foo2 someclient foohost nick2 H@ :0 Long name2\r\n" {
 		t.Fatal("WHO", r)
 	}
 	if r := <-conn.outbound; r != ":foohost 315 nick2 #barenc :End of /WHO list\r\n" {
@@ -234,3 +287,1673 @@ func TestJoin(t *testing.T) {
 	}
 
 }
+
+func TestModerated(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 2; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 = #foo :@nick1 nick2\r\n" {
+		t.Fatal("NAMES with operator", r)
+	}
+	<-conn2.outbound
+	<-conn1.outbound
+
+	conn2.inbound <- "MODE #foo +m"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #foo :You're not channel operator\r\n" {
+		t.Fatal("+m by non operator", r)
+	}
+	for _, mode := range []string{"+k key", "-k"} {
+		conn2.inbound <- "MODE #foo " + mode
+		if r := <-conn2.outbound; r != ":foohost 482 nick2 #foo :You're not channel operator\r\n" {
+			t.Fatal("key change by non operator", mode, r)
+		}
+	}
+	if daemon.rooms["#foo"].key != "" {
+		t.Fatal("key is set by non operator")
+	}
+
+	conn1.inbound <- "MODE #foo +m"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE #foo +m\r\n" {
+			t.Fatal("+m MODE setting", r)
+		}
+	}
+	conn1.inbound <- "MODE #foo"
+	if r := <-conn1.outbound; r != "324 nick1 #foo +m\r\n" {
+		t.Fatal("moderated MODE reply", r)
+	}
+	if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 329 nick1 #foo :") {
+		t.Fatal("creation time MODE reply", r)
+	}
+
+	conn2.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn2.outbound; r != ":foohost 404 nick2 #foo :Cannot send to channel\r\n" {
+		t.Fatal("message to moderated channel", r)
+	}
+
+	conn1.inbound <- "MODE #foo +v nick3"
+	if r := <-conn1.outbound; r != ":foohost 441 nick1 nick3 #foo :They aren't on that channel\r\n" {
+		t.Fatal("voice for non member", r)
+	}
+	conn1.inbound <- "MODE #foo +v nick2"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE #foo +v nick2\r\n" {
+			t.Fatal("+v MODE setting", r)
+		}
+	}
+	conn2.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient PRIVMSG #foo :hello\r\n" {
+		t.Fatal("voiced message", r)
+	}
+
+	conn1.inbound <- "WHO #foo"
+	if r := <-conn1.outbound; r != ":foohost 352 nick1 #foo foo1 someclient foohost nick1 H@ :0 Long name1\r\n" {
+		t.Fatal("WHO operator", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 352 nick1 #foo foo2 someclient foohost nick2 H+ :0 Long name2\r\n" {
+		t.Fatal("WHO voiced", r)
+	}
+	<-conn1.outbound
+
+	conn1.inbound <- "MODE #foo -v nick2"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE #foo -v nick2\r\n" {
+			t.Fatal("-v MODE setting", r)
+		}
+	}
+	conn2.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn2.outbound; r != ":foohost 404 nick2 #foo :Cannot send to channel\r\n" {
+		t.Fatal("message after voice removal", r)
+	}
+}
+
+func TestKill(t *testing.T) {
+	log_sink := make(chan LogEvent, 8)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client1, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn2, "#foo")
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN", r)
+	}
+
+	conn1.inbound <- "KILL nick2 :go away"
+	if r := expectMsg(t, conn1); r != ":foohost 481 nick1 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("KILL by non operator", r)
+	}
+	client1.operator = true
+	conn1.inbound <- "KILL nick2"
+	expectNumeric(t, conn1, "461")
+	conn1.inbound <- "KILL nick3 :go away"
+	expectNumeric(t, conn1, "401")
+
+	conn1.inbound <- "KILL nick2 :go away"
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@someclient KILL nick2 :go away\r\n" {
+		t.Fatal("KILL message", r)
+	}
+	if r := expectMsg(t, conn2); r != "ERROR :Closing Link: nick2 (Killed (nick1 (go away)))\r\n" {
+		t.Fatal("KILL closing link", r)
+	}
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient QUIT :Killed (nick1 (go away))\r\n" {
+		t.Fatal("KILL departure", r)
+	}
+	if !conn2.Closed() {
+		t.Fatal("connection closed after KILL")
+	}
+	conn1.inbound <- "ISON nick2"
+	if r := expectMsg(t, conn1); r != ":foohost 303 nick1 :\r\n" {
+		t.Fatal("killed client removed", r)
+	}
+}
+
+func TestRename(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client1, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn2, "#foo")
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN", r)
+	}
+	conn1.inbound <- "TOPIC #foo :Some topic"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := expectMsg(t, conn); r != ":nick1!foo1@someclient TOPIC #foo :Some topic\r\n" {
+			t.Fatal("TOPIC", r)
+		}
+	}
+	joinRoom(t, conn1, "#baz")
+
+	conn1.inbound <- "RENAME #foo #bar"
+	if r := expectMsg(t, conn1); r != ":foohost 481 nick1 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("RENAME by non operator", r)
+	}
+	client1.operator = true
+	conn1.inbound <- "RENAME #foo"
+	expectNumeric(t, conn1, "461")
+	conn1.inbound <- "RENAME #unknown #bar"
+	expectNumeric(t, conn1, "403")
+	conn1.inbound <- "RENAME #foo bar"
+	expectNumeric(t, conn1, "403")
+	conn1.inbound <- "RENAME #foo #baz"
+	if r := expectMsg(t, conn1); r != ":foohost 437 nick1 #baz :Channel name is already in use\r\n" {
+		t.Fatal("RENAME to existing channel", r)
+	}
+
+	conn1.inbound <- "CAP REQ :draft/channel-rename"
+	if r := expectMsg(t, conn1); r != ":foohost CAP nick1 ACK :draft/channel-rename\r\n" {
+		t.Fatal("CAP REQ", r)
+	}
+	conn1.inbound <- "RENAME #foo #bar :moving"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient RENAME #foo #bar :moving\r\n" {
+		t.Fatal("RENAME to capable client", r)
+	}
+	if r := expectMsg(t, conn2); r != ":nick2!foo2@someclient PART #foo :moving\r\n" {
+		t.Fatal("RENAME PART", r)
+	}
+	if r := expectMsg(t, conn2); r != ":nick2!foo2@someclient JOIN #bar\r\n" {
+		t.Fatal("RENAME JOIN", r)
+	}
+	if r := expectMsg(t, conn2); r != ":foohost 332 nick2 #bar :Some topic\r\n" {
+		t.Fatal("RENAME topic", r)
+	}
+	if r := expectMsg(t, conn2); !strings.HasPrefix(r, ":foohost 333 nick2 #bar nick1!foo1@someclient :") {
+		t.Fatal("RENAME topic setter", r)
+	}
+	if r := expectMsg(t, conn2); r != ":foohost 353 nick2 = #bar :@nick1 nick2\r\n" {
+		t.Fatal("RENAME NAMES", r)
+	}
+	expectNumeric(t, conn2, "366")
+	if _, found := daemon.rooms["#foo"]; found {
+		t.Fatal("#foo still exists")
+	}
+	if r, found := daemon.rooms["#bar"]; !found || r.name != "#bar" {
+		t.Fatal("#bar does not exist")
+	}
+	if r := <-state_sink; (r.where != "#foo") || (r.topic != "Some topic") {
+		t.Fatal("TOPIC state", r)
+	}
+	if r := <-state_sink; (r.where != "#foo") || !r.removed {
+		t.Fatal("RENAME old state removal", r)
+	}
+	if r := <-state_sink; (r.where != "#bar") || (r.topic != "Some topic") || (r.topic_by != "nick1!foo1@someclient") || r.removed {
+		t.Fatal("RENAME state", r)
+	}
+
+	conn2.inbound <- "PRIVMSG #bar :hello"
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient PRIVMSG #bar :hello\r\n" {
+		t.Fatal("message to renamed channel", r)
+	}
+}
+
+// Topic setter and time are replied with 333 after the topic itself
+func TestTopicSetter(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	before := time.Now().Unix()
+	conn1.inbound <- "TOPIC #foo :Some topic"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient TOPIC #foo :Some topic\r\n" {
+		t.Fatal("TOPIC", r)
+	}
+	after := time.Now().Unix()
+
+	conn2.inbound <- "JOIN #foo"
+	if r := expectMsg(t, conn2); r != ":foohost 332 nick2 #foo :Some topic\r\n" {
+		t.Fatal("topic on JOIN", r)
+	}
+	r := expectNumeric(t, conn2, "333")
+	cols := strings.Fields(r)
+	if len(cols) != 6 || cols[4] != "nick1!foo1@someclient" {
+		t.Fatal("topic setter on JOIN", r)
+	}
+	if ts, err := strconv.ParseInt(strings.TrimPrefix(cols[5], ":"), 10, 64); err != nil || ts < before || ts > after {
+		t.Fatal("topic time on JOIN", r)
+	}
+	if r := expectMsg(t, conn2); r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN", r)
+	}
+	expectNumeric(t, conn2, "353")
+	expectNumeric(t, conn2, "366")
+	conn2.inbound <- "TOPIC #foo"
+	if r := expectMsg(t, conn2); r != ":foohost 332 nick2 #foo :Some topic\r\n" {
+		t.Fatal("topic on TOPIC", r)
+	}
+	if r2 := expectNumeric(t, conn2, "333"); !strings.HasSuffix(r2, cols[4]+" "+cols[5]+"\r\n") {
+		t.Fatal("topic setter on TOPIC", r2)
+	}
+}
+
+func TestBans(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+
+	conn1.inbound <- "MODE #foo +b"
+	if r := <-conn1.outbound; r != ":foohost 368 nick1 #foo :End of channel ban list\r\n" {
+		t.Fatal("empty ban list", r)
+	}
+	conn1.inbound <- "MODE #foo +b"
+	<-conn1.outbound
+	conn1.inbound <- "MODE #foo +b NICK2!*@*"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +b NICK2!*@*\r\n" {
+		t.Fatal("+b MODE setting", r)
+	}
+	if r := <-state_sink; (r.where != "#foo") || (len(r.bans) != 1) || (r.bans[0] != "NICK2!*@*") {
+		t.Fatal("+b state", r)
+	}
+	conn1.inbound <- "MODE #foo +b *!*@otherhost"
+	<-conn1.outbound
+	<-state_sink
+	conn1.inbound <- "MODE #foo b"
+	if r := <-conn1.outbound; r != ":foohost 367 nick1 #foo :NICK2!*@*\r\n" {
+		t.Fatal("ban list", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 367 nick1 #foo :*!*@otherhost\r\n" {
+		t.Fatal("ban list", r)
+	}
+	<-conn1.outbound
+
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 474 nick2 #foo :Cannot join channel (+b)\r\n" {
+		t.Fatal("joining with ban", r)
+	}
+	conn2.inbound <- "MODE #foo -b nick2!*@*"
+	if r := <-conn2.outbound; r != ":foohost 442 #foo :You are not on that channel\r\n" {
+		t.Fatal("-b by non member", r)
+	}
+
+	conn1.inbound <- "MODE #foo -b nick2!*@*"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo -b NICK2!*@*\r\n" {
+		t.Fatal("-b MODE setting", r)
+	}
+	if r := <-state_sink; (r.where != "#foo") || (len(r.bans) != 1) || (r.bans[0] != "*!*@otherhost") {
+		t.Fatal("-b state", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 331 nick2 #foo :No topic is set\r\n" {
+		t.Fatal("joining after ban removal", r)
+	}
+	for i := 0; i < 3; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+
+	conn2.inbound <- "MODE #foo +b nick1!*@*"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #foo :You're not channel operator\r\n" {
+		t.Fatal("+b by non operator", r)
+	}
+}
+
+func TestBanLimits(t *testing.T) {
+	log_sink := make(chan LogEvent, LIST_MAX+8)
+	state_sink := make(chan StateEvent, LIST_MAX+8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client, conn := registerClient(t, daemon, events, "nick1", strings.Repeat("u", 100))
+	if len(client.username) != USERNAME_LEN {
+		t.Fatal("long username is not truncated", client.username)
+	}
+	joinRoom(t, conn, "#foo")
+
+	conn.inbound <- "MODE #foo +b " + strings.Repeat("a", MASK_LEN+1)
+	if r := expectNumeric(t, conn, "696"); !strings.HasPrefix(r, ":foohost 696 nick1 #foo b ") {
+		t.Fatal("too long mask", r)
+	}
+	conn.inbound <- "MODE #foo +b " + strings.Repeat("*a", MASK_WILDCARDS+1)
+	if r := expectNumeric(t, conn, "696"); !strings.HasPrefix(r, ":foohost 696 nick1 #foo b ") {
+		t.Fatal("too complex mask", r)
+	}
+	for i := 0; i < LIST_MAX; i++ {
+		mask := fmt.Sprintf("*!*@10.0.0.%d", i)
+		conn.inbound <- "MODE #foo +b " + mask
+		if r := expectMsg(t, conn); !strings.HasSuffix(r, " MODE #foo +b "+mask+"\r\n") {
+			t.Fatal("ban setting", r)
+		}
+	}
+	conn.inbound <- "MODE #foo +b *!*@10.0.1.1"
+	if r := expectMsg(t, conn); r != ":foohost 478 nick1 #foo b :Channel list is full\r\n" {
+		t.Fatal("ban list overflow", r)
+	}
+}
+
+func TestSanick(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client1, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn2, "#foo")
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN", r)
+	}
+
+	conn1.inbound <- "SANICK nick2 nick3"
+	if r := expectMsg(t, conn1); r != ":foohost 481 nick1 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("SANICK by non operator", r)
+	}
+	client1.operator = true
+	conn1.inbound <- "SANICK nick2"
+	expectNumeric(t, conn1, "461")
+	conn1.inbound <- "SANICK nick4 nick3"
+	expectNumeric(t, conn1, "401")
+	conn1.inbound <- "SANICK nick2 #nick3"
+	if r := expectMsg(t, conn1); r != ":foohost 432 nick1 #nick3 :Erroneous nickname\r\n" {
+		t.Fatal("SANICK to erroneous nickname", r)
+	}
+	conn1.inbound <- "SANICK nick2 NICK1"
+	if r := expectMsg(t, conn1); r != ":foohost 433 nick1 NICK1 :Nickname is already in use\r\n" {
+		t.Fatal("SANICK to used nickname", r)
+	}
+
+	conn1.inbound <- "SANICK NICK2 nick3"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := expectMsg(t, conn); r != ":nick2!foo2@someclient NICK :nick3\r\n" {
+			t.Fatal("SANICK broadcast", r)
+		}
+	}
+	<-log_sink
+	<-log_sink
+	if r := <-log_sink; (r.what != "changed nickname to nick3") || (r.where != "#foo") || (r.who != "nick2") {
+		t.Fatal("SANICK log", r)
+	}
+	conn1.inbound <- "PRIVMSG #foo :hello"
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@someclient PRIVMSG #foo :hello\r\n" {
+		t.Fatal("message after SANICK", r)
+	}
+	conn1.inbound <- "ISON nick2 nick3"
+	if r := expectMsg(t, conn1); r != ":foohost 303 nick1 :nick3\r\n" {
+		t.Fatal("ISON after SANICK", r)
+	}
+}
+
+func TestMultiPrefix(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	conn3 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	client3 := NewClient("foohost", conn3)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	go client3.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	conn3.inbound <- "CAP LS\r\nCAP REQ :multi-prefix\r\nNICK nick3\r\nUSER foo3 bar3 baz3 :Long name3\r\nCAP END"
+	for i := 0; i < 9; i++ {
+		<-conn3.outbound
+	}
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "MODE #foo +v nick1"
+	<-conn1.outbound
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 2; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 = #foo :@nick1 nick2\r\n" {
+		t.Fatal("NAMES without multi-prefix", r)
+	}
+	<-conn2.outbound
+	<-conn1.outbound
+	conn3.inbound <- "JOIN #foo"
+	for i := 0; i < 2; i++ {
+		<-conn3.outbound
+	}
+	if r := <-conn3.outbound; r != ":foohost 353 nick3 = #foo :@+nick1 nick2 nick3\r\n" {
+		t.Fatal("NAMES with multi-prefix", r)
+	}
+	<-conn3.outbound
+	<-conn1.outbound
+	<-conn2.outbound
+
+	conn3.inbound <- "WHO #foo"
+	if r := <-conn3.outbound; r != ":foohost 352 nick3 #foo foo1 someclient foohost nick1 H@+ :0 Long name1\r\n" {
+		t.Fatal("WHO with multi-prefix", r)
+	}
+	for i := 0; i < 3; i++ {
+		<-conn3.outbound
+	}
+	conn2.inbound <- "WHO #foo"
+	if r := <-conn2.outbound; r != ":foohost 352 nick2 #foo foo1 someclient foohost nick1 H@ :0 Long name1\r\n" {
+		t.Fatal("WHO without multi-prefix", r)
+	}
+}
+
+func TestNamesx(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	conn2.inbound <- "MODE #foo +v nick2"
+	<-conn2.outbound
+
+	conn1.inbound <- "PROTOCTL NAMESX\r\nJOIN #foo"
+	for i := 0; i < 2; i++ {
+		<-conn1.outbound
+	}
+	if r := <-conn1.outbound; r != ":foohost 353 nick1 = #foo :nick1 @+nick2\r\n" {
+		t.Fatal("NAMES with NAMESX", r)
+	}
+	<-conn1.outbound
+	<-conn2.outbound
+	if !client1.caps["multi-prefix"] {
+		t.Fatal("NAMESX enables multi-prefix")
+	}
+}
+
+func TestUhnames(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	conn3 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	client3 := NewClient("foohost", conn3)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	go client3.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "CAP REQ :userhost-in-names\r\nNICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\nCAP END"
+	conn3.inbound <- "NICK nick3\r\nUSER foo3 bar3 baz3 :Long name3\r\nPROTOCTL UHNAMES"
+	for i := 0; i < 8; i++ {
+		<-conn2.outbound
+	}
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn3.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 2; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 = #foo :@nick1!foo1@someclient nick2!foo2@someclient\r\n" {
+		t.Fatal("NAMES with userhost-in-names", r)
+	}
+	<-conn2.outbound
+	<-conn1.outbound
+	conn3.inbound <- "JOIN #foo"
+	for i := 0; i < 2; i++ {
+		<-conn3.outbound
+	}
+	if r := <-conn3.outbound; r != ":foohost 353 nick3 = #foo :@nick1!foo1@someclient nick2!foo2@someclient nick3!foo3@someclient\r\n" {
+		t.Fatal("NAMES with UHNAMES", r)
+	}
+}
+
+func TestSecretPrivate(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #sec"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "JOIN #priv"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "TOPIC #priv :hidden"
+	<-conn1.outbound
+	conn2.inbound <- "MODE #sec +s"
+	if r := <-conn2.outbound; r != ":foohost 442 #sec :You are not on that channel\r\n" {
+		t.Fatal("+s by non-member", r)
+	}
+	conn1.inbound <- "MODE #sec +s"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #sec +s\r\n" {
+		t.Fatal("+s", r)
+	}
+	conn1.inbound <- "MODE #priv +p"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #priv +p\r\n" {
+		t.Fatal("+p", r)
+	}
+	conn1.inbound <- "MODE #sec"
+	if r := <-conn1.outbound; r != "324 nick1 #sec +s\r\n" {
+		t.Fatal("324 secret", r)
+	}
+	<-conn1.outbound
+	conn1.inbound <- "LIST"
+	if r := <-conn1.outbound; r != ":foohost 322 nick1 #priv 1 :hidden\r\n" {
+		t.Fatal("LIST private for member", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 322 nick1 #sec 1 :\r\n" {
+		t.Fatal("LIST secret for member", r)
+	}
+	<-conn1.outbound
+	conn2.inbound <- "LIST"
+	if r := <-conn2.outbound; r != ":foohost 322 nick2 #priv 1 :\r\n" {
+		t.Fatal("LIST private for non-member", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 323 nick2 :End of /LIST\r\n" {
+		t.Fatal("LIST secret for non-member", r)
+	}
+
+	conn2.inbound <- "JOIN #sec"
+	for i := 0; i < 2; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 @ #sec :@nick1 nick2\r\n" {
+		t.Fatal("NAMES secret", r)
+	}
+	<-conn2.outbound
+	<-conn1.outbound
+	conn2.inbound <- "JOIN #priv"
+	for i := 0; i < 3; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 * #priv :@nick1 nick2\r\n" {
+		t.Fatal("NAMES private", r)
+	}
+	<-conn2.outbound
+	<-conn1.outbound
+	conn2.inbound <- "LIST"
+	if r := <-conn2.outbound; r != ":foohost 322 nick2 #priv 2 :hidden\r\n" {
+		t.Fatal("LIST private for member", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 322 nick2 #sec 2 :\r\n" {
+		t.Fatal("LIST secret for member", r)
+	}
+	<-conn2.outbound
+}
+
+// Secret channel is listed to its member, but not to outsider, both
+// in full LIST and in LIST of that channel
+func TestListSecretMember(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#sec")
+	conn1.inbound <- "MODE #sec +s"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE #sec +s\r\n" {
+		t.Fatal("MODE +s", r)
+	}
+
+	for _, query := range []string{"LIST", "LIST #sec"} {
+		conn1.inbound <- query
+		if r := expectMsg(t, conn1); r != ":foohost 322 nick1 #sec 1 :\r\n" {
+			t.Fatal("secret channel is not listed to member", query, r)
+		}
+		expectNumeric(t, conn1, "323")
+		conn2.inbound <- query
+		if r := expectMsg(t, conn2); r != ":foohost 323 nick2 :End of /LIST\r\n" {
+			t.Fatal("secret channel is listed to outsider", query, r)
+		}
+	}
+}
+
+func TestQuit(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	conn3 := NewTestingConn()
+	client1 := NewClient("foohost", conn1)
+	client2 := NewClient("foohost", conn2)
+	client3 := NewClient("foohost", conn3)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	go client3.Processor(events)
+
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\n"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\n"
+	conn3.inbound <- "NICK nick3\r\nUSER foo3 bar3 baz3 :Long name3\r\n"
+	for i := 0; i < 7; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+		<-conn3.outbound
+	}
+	for _, room := range []string{"#foo", "#bar"} {
+		conn1.inbound <- "JOIN " + room
+		for i := 0; i < 4; i++ {
+			<-conn1.outbound
+		}
+		conn2.inbound <- "JOIN " + room
+		for i := 0; i < 4; i++ {
+			<-conn2.outbound
+		}
+		<-conn1.outbound
+	}
+	conn3.inbound <- "JOIN #bar"
+	for i := 0; i < 4; i++ {
+		<-conn3.outbound
+	}
+	<-conn1.outbound
+	<-conn2.outbound
+	for len(log_sink) > 0 {
+		<-log_sink
+	}
+
+	conn1.inbound <- "QUIT :Gone fishing"
+	if r := <-conn1.outbound; r != "ERROR :Closing Link: nick1\r\n" {
+		t.Fatal("QUIT reply", r)
+	}
+	for _, conn := range []*TestingConn{conn2, conn3} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient QUIT :Gone fishing\r\n" {
+			t.Fatal("QUIT with reason", r)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if r := <-log_sink; r.what != "quit: Gone fishing" || r.who != "nick1" {
+			t.Fatal("QUIT log", r)
+		}
+	}
+
+	conn3.inbound <- "QUIT"
+	<-conn3.outbound
+	if r := <-conn2.outbound; r != ":nick3!foo3@someclient QUIT :Client Quit\r\n" {
+		t.Fatal("QUIT without reason", r)
+	}
+	conn2.inbound <- "WHO #foo"
+	if r := <-conn2.outbound; !strings.Contains(r, " nick2 ") {
+		t.Fatal("quitted client is still member", r)
+	}
+	if r := <-conn2.outbound; !strings.Contains(r, "315") {
+		t.Fatal("quitted client is still member", r)
+	}
+
+	conn4 := NewTestingConn()
+	client4 := NewClient("foohost", conn4)
+	go client4.Processor(events)
+	conn4.inbound <- "NICK nick4\r\nUSER foo4 bar4 baz4 :Long name4\r\nJOIN #foo"
+	for i := 0; i < 11; i++ {
+		<-conn4.outbound
+	}
+	<-conn2.outbound
+	for len(log_sink) > 0 {
+		<-log_sink
+	}
+	conn4.inbound <- ""
+	if r := <-conn2.outbound; r != ":nick4!foo4@someclient QUIT :Connection closed\r\n" {
+		t.Fatal("QUIT on disconnect", r)
+	}
+	if r := <-log_sink; r.what != "quit: Connection closed" || r.who != "nick4" {
+		t.Fatal("QUIT on disconnect log", r)
+	}
+}
+
+func TestPartReason(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	for _, room := range []string{"#foo", "#bar", "#baz"} {
+		joinRoom(t, conn1, room)
+		joinRoom(t, conn2, room)
+		expectMsg(t, conn1)
+	}
+
+	conn2.inbound <- "PART #foo,#bar :See you later"
+	parts := []string{expectMsg(t, conn1), expectMsg(t, conn1)}
+	sort.Strings(parts)
+	if parts[0] != ":nick2!foo2@someclient PART #bar :See you later\r\n" ||
+		parts[1] != ":nick2!foo2@someclient PART #foo :See you later\r\n" {
+		t.Fatal("PART with reason", parts)
+	}
+	conn2.inbound <- "PART #baz"
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient PART #baz\r\n" {
+		t.Fatal("PART without reason", r)
+	}
+}
+
+func TestNoExternal(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+
+	for len(log_sink) > 0 {
+		<-log_sink
+	}
+	conn2.inbound <- "PRIVMSG #foo :from outside"
+	expectNumeric(t, conn2, "404")
+	conn1.inbound <- "PING foo"
+	if r := expectMsg(t, conn1); r != ":foohost PONG foohost :foo\r\n" {
+		t.Fatal("external message without +n is broadcasted", r)
+	}
+	if len(log_sink) != 0 {
+		t.Fatal("external message without +n is logged", <-log_sink)
+	}
+
+	conn2.inbound <- "MODE #foo +n"
+	if r := expectMsg(t, conn2); r != ":foohost 442 #foo :You are not on that channel\r\n" {
+		t.Fatal("+n by non-member", r)
+	}
+	conn1.inbound <- "MODE #foo +n"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE #foo +n\r\n" {
+		t.Fatal("+n", r)
+	}
+	conn1.inbound <- "MODE #foo"
+	if r := expectMsg(t, conn1); r != "324 nick1 #foo +n\r\n" {
+		t.Fatal("324 with +n", r)
+	}
+	expectNumeric(t, conn1, "329")
+	for len(log_sink) > 0 {
+		<-log_sink
+	}
+	conn2.inbound <- "PRIVMSG #foo :from outside"
+	expectNumeric(t, conn2, "404")
+	conn1.inbound <- "PING foo"
+	if r := expectMsg(t, conn1); r != ":foohost PONG foohost :foo\r\n" {
+		t.Fatal("external message with +n is broadcasted", r)
+	}
+	if len(log_sink) != 0 {
+		t.Fatal("external message with +n is logged", <-log_sink)
+	}
+
+	conn1.inbound <- "MODE #foo -n"
+	expectMsg(t, conn1)
+	conn2.inbound <- "NOTICE #foo :from outside again"
+	expectNumeric(t, conn2, "404")
+	joinRoom(t, conn2, "#foo")
+	expectMsg(t, conn1)
+	conn2.inbound <- "NOTICE #foo :from inside"
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient NOTICE #foo :from inside\r\n" {
+		t.Fatal("message from member", r)
+	}
+}
+
+func TestJoinZero(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn1, "#bar")
+	joinRoom(t, conn2, "#foo")
+	expectMsg(t, conn1)
+	for len(log_sink) > 0 {
+		<-log_sink
+	}
+
+	conn1.inbound <- "JOIN 0"
+	parts := []string{expectMsg(t, conn1), expectMsg(t, conn1)}
+	sort.Strings(parts)
+	if parts[0] != ":nick1!foo1@someclient PART #bar\r\n" || parts[1] != ":nick1!foo1@someclient PART #foo\r\n" {
+		t.Fatal("JOIN 0 parts", parts)
+	}
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@someclient PART #foo\r\n" {
+		t.Fatal("JOIN 0 part broadcast", r)
+	}
+	for i := 0; i < 2; i++ {
+		if r := <-log_sink; r.what != "left" || r.who != "nick1" {
+			t.Fatal("JOIN 0 part log", r)
+		}
+	}
+	if _, found := daemon.rooms["#0"]; found {
+		t.Fatal("JOIN 0 created room")
+	}
+	conn1.inbound <- "PRIVMSG #foo :still here?"
+	expectNumeric(t, conn1, "404")
+	conn2.inbound <- "WHO #foo"
+	if r := expectNumeric(t, conn2, "352"); !strings.Contains(r, " nick2 ") {
+		t.Fatal("JOIN 0 membership", r)
+	}
+	expectNumeric(t, conn2, "315")
+}
+
+func TestRoomCaseInsensitive(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	conn2.inbound <- "JOIN #Foo"
+	expectNumeric(t, conn2, "331")
+	if r := expectMsg(t, conn2); r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN of differently cased room", r)
+	}
+	expectNumeric(t, conn2, "353")
+	expectNumeric(t, conn2, "366")
+	expectMsg(t, conn1)
+
+	conn2.inbound <- "TOPIC #FOO :hi"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := expectMsg(t, conn); r != ":nick2!foo2@someclient TOPIC #foo :hi\r\n" {
+			t.Fatal("TOPIC of differently cased room", r)
+		}
+	}
+	conn1.inbound <- "PRIVMSG #fOO :hello"
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@someclient PRIVMSG #foo :hello\r\n" {
+		t.Fatal("PRIVMSG to differently cased room", r)
+	}
+	conn1.inbound <- "LIST #FOO"
+	if r := expectMsg(t, conn1); r != ":foohost 322 nick1 #foo 2 :hi\r\n" {
+		t.Fatal("LIST of differently cased room", r)
+	}
+	expectNumeric(t, conn1, "323")
+	conn1.inbound <- "WHO #FoO"
+	expectNumeric(t, conn1, "352")
+	expectNumeric(t, conn1, "352")
+	expectNumeric(t, conn1, "315")
+	conn2.inbound <- "PART #FOO"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := expectMsg(t, conn); r != ":nick2!foo2@someclient PART #foo\r\n" {
+			t.Fatal("PART of differently cased room", r)
+		}
+	}
+}
+
+func TestRoomNameSanitize(t *testing.T) {
+	for name, want := range map[string]string{"#foo": "#foo", "&foo": "#foo", "&": "#"} {
+		if got, _ := RoomNameSanitize(name); got != want {
+			t.Fatal("sanitized name", name, got)
+		}
+	}
+	if _, valid := RoomNameSanitize("&"); valid {
+		t.Fatal("empty room name is valid")
+	}
+	if _, valid := RoomNameSanitize("foo"); valid {
+		t.Fatal("room name without prefix is valid")
+	}
+
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	conn1.inbound <- "JOIN &foo key"
+	expectNumeric(t, conn1, "331")
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient JOIN #foo\r\n" {
+		t.Fatal("JOIN of sanitized room", r)
+	}
+	expectNumeric(t, conn1, "353")
+	expectNumeric(t, conn1, "366")
+	if r := <-state_sink; r.where != "#foo" || r.key != "key" {
+		t.Fatal("state of sanitized room", r)
+	}
+	conn2.inbound <- "JOIN #foo key"
+	expectNumeric(t, conn2, "331")
+	expectMsg(t, conn2)
+	if r := expectNumeric(t, conn2, "353"); r != ":foohost 353 nick2 = #foo :@nick1 nick2\r\n" {
+		t.Fatal("membership of sanitized room", r)
+	}
+	expectNumeric(t, conn2, "366")
+	expectMsg(t, conn1)
+	conn2.inbound <- "PART &foo"
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@someclient PART #foo\r\n" {
+		t.Fatal("PART of sanitized room", r)
+	}
+}
+
+func TestDebugRoom(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	// sha256("secret")
+	daemon.Opers = map[string]string{"admin": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	conn1.inbound <- "JOIN #foo key"
+	for i := 0; i < 4; i++ {
+		expectMsg(t, conn1)
+	}
+	conn1.inbound <- "MODE #foo +b bad!*@*"
+	expectMsg(t, conn1)
+	conn1.inbound <- "TOPIC #foo :Some topic"
+	expectMsg(t, conn1)
+
+	conn2.inbound <- "DEBUG ROOM #foo"
+	expectNumeric(t, conn2, "481")
+	conn2.inbound <- "OPER admin secret"
+	expectNumeric(t, conn2, "381")
+	conn2.inbound <- "DEBUG ROOM"
+	expectNumeric(t, conn2, "461")
+	conn2.inbound <- "DEBUG ROOM #bar"
+	expectNumeric(t, conn2, "403")
+	conn2.inbound <- "DEBUG ROOM #FOO"
+	for _, want := range []string{
+		"members: 1, operators: 1, voiced: 0",
+		"modes: +k key",
+		"bans: 1",
+		"exceptions: 0",
+		`topic: "Some topic"`,
+	} {
+		if r := expectMsg(t, conn2); r != ":foohost NOTICE nick2 :#foo "+want+"\r\n" {
+			t.Fatal("DEBUG ROOM", want, r)
+		}
+	}
+	if r := expectMsg(t, conn2); !strings.HasPrefix(r, ":foohost NOTICE nick2 :#foo created: ") {
+		t.Fatal("DEBUG ROOM creation time", r)
+	}
+}
+
+func TestJoinSimultaneousCreation(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	conns := []*TestingConn{}
+	for i := 0; i < 4; i++ {
+		_, conn := registerClient(t, daemon, events, "nick"+strconv.Itoa(i), "foo")
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.inbound <- "JOIN #new"
+	}
+	operators := 0
+	for _, conn := range conns {
+		for {
+			r := expectMsg(t, conn)
+			if strings.Contains(r, " 366 ") {
+				break
+			}
+			if !strings.Contains(r, " 353 ") {
+				continue
+			}
+			for _, name := range strings.Fields(r[strings.LastIndex(r, ":")+1:]) {
+				if name == "@"+strings.Fields(r)[2] {
+					operators++
+				}
+			}
+		}
+	}
+	if operators != 1 {
+		t.Fatal("room created several times", operators)
+	}
+	_, conn := registerClient(t, daemon, events, "lister", "foo")
+	conn.inbound <- "LIST"
+	if r := expectNumeric(t, conn, "322"); r != ":foohost 322 lister #new 4 :\r\n" {
+		t.Fatal("all clients in the same room", r)
+	}
+	expectNumeric(t, conn, "323")
+}
+
+func TestBanExceptions(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	joinRoom(t, conn1, "#foo")
+
+	conn2 := NewTestingConn()
+	conn2.addr = TestingAddr("10.1.2.3:12345")
+	client2 := NewClient("foohost", conn2)
+	go client2.Processor(events)
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	expectWelcome(t, conn2)
+
+	conn1.inbound <- "MODE #foo +b *!*@10.1.2.3"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE #foo +b *!*@10.1.2.3\r\n" {
+		t.Fatal("ban set", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := expectMsg(t, conn2); r != ":foohost 474 nick2 #foo :Cannot join channel (+b)\r\n" {
+		t.Fatal("banned by real IP", r)
+	}
+
+	conn2.inbound <- "MODE #foo +e nick2!*@*"
+	expectNumeric(t, conn2, "442")
+	conn1.inbound <- "MODE #foo +e nick2!*@*"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE #foo +e nick2!*@*\r\n" {
+		t.Fatal("exception set", r)
+	}
+	conn1.inbound <- "MODE #foo e"
+	if r := expectMsg(t, conn1); r != ":foohost 348 nick1 #foo :nick2!*@*\r\n" {
+		t.Fatal("exception list", r)
+	}
+	expectNumeric(t, conn1, "349")
+	joinRoom(t, conn2, "#foo")
+	if r := expectMsg(t, conn1); r != ":nick2!foo2@10.1.2.3 JOIN #foo\r\n" {
+		t.Fatal("excepted join", r)
+	}
+
+	conn1.inbound <- "MODE #foo -e NICK2!*@*"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE #foo -e nick2!*@*\r\n" {
+		t.Fatal("exception removal", r)
+	}
+	<-state_sink
+	if state := <-state_sink; len(state.excepts) != 1 {
+		t.Fatal("exception is not saved", state)
+	}
+	if state := <-state_sink; len(state.excepts) != 0 || len(state.bans) != 1 {
+		t.Fatal("exception removal is not saved", state)
+	}
+}
+
+func TestNamesSplit(t *testing.T) {
+	room := NewRoom("foohost", "#foo", nil, nil)
+	for i := 0; i < 40; i++ {
+		member := NewClient("foohost", NewTestingConn())
+		member.nickname = fmt.Sprintf("nickname%02d", i)
+		member.username = strings.Repeat("user", 4)
+		room.members[member] = true
+		if i%3 == 0 {
+			room.operators[member] = true
+			room.voiced[member] = true
+		}
+	}
+	conn := NewTestingConn()
+	client := NewClient("foohost", conn)
+	client.nickname = "nick"
+	client.caps["userhost-in-names"] = true
+	client.caps["multi-prefix"] = true
+	room.SendNames(client)
+
+	names := 0
+	replies := 0
+	for {
+		r := expectMsg(t, conn)
+		if r == ":foohost 366 nick #foo :End of NAMES list\r\n" {
+			break
+		}
+		if !strings.HasPrefix(r, ":foohost 353 nick = #foo :") {
+			t.Fatal("NAMES reply", r)
+		}
+		if len(r) > MAX_LINE {
+			t.Fatal("too long NAMES reply", len(r), r)
+		}
+		for _, name := range strings.Fields(strings.SplitN(r, " :", 2)[1]) {
+			if !strings.Contains(name, "!"+strings.Repeat("user", 4)+"@someclient") {
+				t.Fatal("NAMES entry without hostmask", name)
+			}
+			names++
+		}
+		replies++
+	}
+	if names != 40 || replies < 3 {
+		t.Fatal("NAMES split", names, replies)
+	}
+}
+
+func TestListModesQuery(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn := registerClient(t, daemon, events, "nick", "foo")
+	joinRoom(t, conn, "#foo")
+	for _, mode := range []string{"+b bad1!*@*", "+b bad2!*@*", "+e good!*@*"} {
+		conn.inbound <- "MODE #foo " + mode
+		if r := expectMsg(t, conn); r != ":nick!foo@someclient MODE #foo "+mode+"\r\n" {
+			t.Fatal("list mode set", r)
+		}
+	}
+
+	conn.inbound <- "MODE #foo +beI"
+	for _, want := range []string{
+		"367 nick #foo :bad1!*@*",
+		"367 nick #foo :bad2!*@*",
+		"368 nick #foo :End of channel ban list",
+		"348 nick #foo :good!*@*",
+		"349 nick #foo :End of channel exception list",
+		"472 nick I :is unknown mode char to me for #foo",
+	} {
+		if r := expectMsg(t, conn); r != ":foohost "+want+"\r\n" {
+			t.Fatal("list modes query", want, r)
+		}
+	}
+	conn.inbound <- "MODE #foo e"
+	expectNumeric(t, conn, "348")
+	expectNumeric(t, conn, "349")
+
+	conn.inbound <- "MODE #foo"
+	if r := expectMsg(t, conn); r != "324 nick #foo +\r\n" {
+		t.Fatal("modes query", r)
+	}
+	expectNumeric(t, conn, "329")
+	conn.inbound <- "MODE #foo -b"
+	expectNumeric(t, conn, "461")
+}
+
+func TestQuitDuringJoin(t *testing.T) {
+	log_sink := make(chan LogEvent, 256)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	observer, conn := registerClient(t, daemon, events, "observer", "foo")
+	joinRoom(t, conn, "#foo")
+	for i := 0; i < 50; i++ {
+		client, _ := registerClient(t, daemon, events, fmt.Sprintf("nick%d", i), "bar")
+		events <- ClientEvent{client, EVENT_MSG, "JOIN #foo"}
+		events <- ClientEvent{client, EVENT_DEL, ""}
+		events <- ClientEvent{observer, EVENT_MSG, "MODE #foo"}
+		joined := false
+		for {
+			r := expectMsg(t, conn)
+			if strings.HasPrefix(r, "324 ") {
+				break
+			}
+			switch r {
+			case fmt.Sprintf(":nick%d!bar@someclient JOIN #foo\r\n", i):
+				joined = true
+			case fmt.Sprintf(":nick%d!bar@someclient QUIT :Connection closed\r\n", i):
+				if !joined {
+					t.Fatal("QUIT without JOIN", r)
+				}
+				joined = false
+			default:
+				t.Fatal("unexpected message", r)
+			}
+		}
+		expectNumeric(t, conn, "329")
+		if joined {
+			t.Fatal("joined client quit is not announced", i)
+		}
+		room, _ := daemon.RoomByName("#foo")
+		room.RLock()
+		members := len(room.members)
+		room.RUnlock()
+		if members != 1 {
+			t.Fatal("quitted client is left in room", i, members)
+		}
+	}
+}
+
+func TestChancreateRate(t *testing.T) {
+	client := NewClient("foohost", NewTestingConn())
+	now := time.Unix(1234567890, 0)
+	if !client.ChancreateCheck(2, now) || !client.ChancreateCheck(2, now.Add(time.Second)) {
+		t.Fatal("creation within limit is rejected")
+	}
+	if client.ChancreateCheck(2, now.Add(2*time.Second)) {
+		t.Fatal("creation over limit is allowed")
+	}
+	if !client.ChancreateCheck(2, now.Add(CHANCREATE_WINDOW)) {
+		t.Fatal("creation after window slided is rejected")
+	}
+
+	log_sink := make(chan LogEvent, 64)
+	state_sink := make(chan StateEvent, 64)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.ChancreateRate = 3
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+
+	for i := 0; i < 3; i++ {
+		joinRoom(t, conn1, fmt.Sprintf("#room%d", i))
+	}
+	conn1.inbound <- "JOIN #room3"
+	if r := expectMsg(t, conn1); r != ":foohost 480 nick1 #room3 :Cannot create channel (throttled), try again later\r\n" {
+		t.Fatal("channel creation over limit", r)
+	}
+	joinRoom(t, conn2, "#room0")
+	expectMsg(t, conn1)
+	conn1.inbound <- "PART #room0\r\nJOIN #room0"
+	expectMsg(t, conn1)
+	expectMsg(t, conn2)
+	expectMsg(t, conn1)
+	if r := expectMsg(t, conn1); !strings.HasPrefix(r, ":nick1!foo1@someclient JOIN #room0") {
+		t.Fatal("joining existing channel over creation limit", r)
+	}
+}
+
+func TestSecretWho(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#sec")
+	joinRoom(t, conn1, "#pub")
+	conn1.inbound <- "MODE #sec +s"
+	expectMsg(t, conn1)
+
+	conn2.inbound <- "WHO #SEC"
+	if r := expectMsg(t, conn2); r != ":foohost 403 nick2 #SEC :No such channel\r\n" {
+		t.Fatal("WHO secret for non-member", r)
+	}
+	conn2.inbound <- "WHOIS nick1"
+	for {
+		r := expectMsg(t, conn2)
+		if strings.HasPrefix(r, ":foohost 318 ") {
+			t.Fatal("no subscriptions in WHOIS")
+		}
+		if strings.HasPrefix(r, ":foohost 319 ") {
+			if r != ":foohost 319 nick2 nick1 :#pub\r\n" {
+				t.Fatal("WHOIS secret for non-member", r)
+			}
+			break
+		}
+	}
+	expectNumeric(t, conn2, "318")
+
+	joinRoom(t, conn2, "#sec")
+	expectMsg(t, conn1)
+	conn2.inbound <- "WHO #sec"
+	expectNumeric(t, conn2, "352")
+	expectNumeric(t, conn2, "352")
+	expectNumeric(t, conn2, "315")
+	conn2.inbound <- "WHOIS nick1"
+	for {
+		r := expectMsg(t, conn2)
+		if strings.HasPrefix(r, ":foohost 319 ") {
+			if r != ":foohost 319 nick2 nick1 :#pub #sec\r\n" {
+				t.Fatal("WHOIS secret for member", r)
+			}
+			break
+		}
+	}
+}
+
+// Accounts service reserving nicknames to accounts listed in reserved,
+// accepting "secret" password and recording ownership checks.
+type fakeAccounts struct {
+	reserved map[string]string
+	checks   []string
+}
+
+func (accounts *fakeAccounts) Lookup(nickname string) string {
+	return accounts.reserved[nickname]
+}
+
+func (accounts *fakeAccounts) Authenticate(account, password string) bool {
+	return password == "secret"
+}
+
+func (accounts *fakeAccounts) Owns(account, nickname string) bool {
+	accounts.checks = append(accounts.checks, account+" "+nickname)
+	return account == nickname
+}
+
+func TestRegisteredOnly(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	accounts := &fakeAccounts{reserved: map[string]string{"bot": "bot", "eve": "bot"}}
+	daemon.AccountService = accounts
+	daemon.ReserveNicks = true
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	joinRoom(t, conn1, "#foo")
+	conn1.inbound <- "MODE #foo +R"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE #foo +R\r\n" {
+		t.Fatal("+R set", r)
+	}
+	conn1.inbound <- "MODE #foo"
+	if r := expectMsg(t, conn1); r != "324 nick1 #foo +R\r\n" {
+		t.Fatal("+R in modes", r)
+	}
+
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	conn2.inbound <- "JOIN #foo"
+	if r := expectMsg(t, conn2); r != ":foohost 477 nick2 #foo :Cannot join channel (+R) - you need to be identified\r\n" {
+		t.Fatal("unidentified join", r)
+	}
+
+	conns := []*TestingConn{}
+	for _, nickname := range []string{"bot", "eve"} {
+		conn := NewTestingConn()
+		client := NewClient("foohost", conn)
+		go client.Processor(events)
+		conn.inbound <- "PASS secret\r\nNICK " + nickname + "\r\nUSER foo bar baz :Long name"
+		for i := 0; i < 7; i++ {
+			expectMsg(t, conn)
+		}
+		conns = append(conns, conn)
+	}
+	joinRoom(t, conns[0], "#foo")
+	conns[1].inbound <- "JOIN #foo"
+	if r := expectMsg(t, conns[1]); r != ":foohost 477 eve #foo :Cannot join channel (+R) - you need to be identified\r\n" {
+		t.Fatal("join with not owned nickname", r)
+	}
+	if len(accounts.checks) < 2 ||
+		accounts.checks[len(accounts.checks)-2] != "bot bot" ||
+		accounts.checks[len(accounts.checks)-1] != "bot eve" {
+		t.Fatal("accounts service is not consulted", accounts.checks)
+	}
+}
+
+func TestMaxChannels(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.MaxChannels = 2
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	client, conn := registerClient(t, daemon, events, "nick1", "foo1")
+	// Wait for joining one room and refusal of another one
+	joinRefused := func(joining, refused string) {
+		t.Helper()
+		joined, rejected := false, false
+		for !joined || !rejected {
+			r := expectMsg(t, conn)
+			if strings.HasPrefix(r, ":foohost 366 nick1 "+joining+" ") {
+				joined = true
+			} else if r == ":foohost 405 nick1 "+refused+" :You have joined too many channels\r\n" {
+				rejected = true
+			} else if strings.Contains(r, refused) {
+				t.Fatal("join exceeding limit", r)
+			}
+		}
+	}
+	joinRoom(t, conn, "#foo")
+	conn.inbound <- "JOIN #bar,#baz"
+	joinRefused("#bar", "#baz")
+	joinRoom(t, conn, "#foo")
+	conn.inbound <- "PART #bar"
+	if r := expectMsg(t, conn); r != ":nick1!foo1@someclient PART #bar\r\n" {
+		t.Fatal("part", r)
+	}
+
+	// Separate commands are counted without waiting for rooms
+	conn.inbound <- "JOIN #baz\r\nJOIN #qux"
+	joinRefused("#baz", "#qux")
+	if n := len(client.rooms); n != 2 {
+		t.Fatal("memberships are not indexed", n)
+	}
+}
+
+func TestMaxMessage(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.MaxMessage = 10
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn2, "#foo")
+	expectMsg(t, conn1)
+
+	conn1.inbound <- "PRIVMSG #foo :" + strings.Repeat("x", 11)
+	if r := expectMsg(t, conn1); r != ":foohost 404 nick1 #foo :Cannot send to channel (message is too long)\r\n" {
+		t.Fatal("oversized message", r)
+	}
+	conn1.inbound <- "PRIVMSG #foo :" + strings.Repeat("x", 10)
+	if r := expectMsg(t, conn2); r != ":nick1!foo1@someclient PRIVMSG #foo :xxxxxxxxxx\r\n" {
+		t.Fatal("message of max length", r)
+	}
+}
+
+func TestMultipleTargets(t *testing.T) {
+	log_sink := make(chan LogEvent, 16)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	_, conn2 := registerClient(t, daemon, events, "nick2", "foo2")
+	_, conn3 := registerClient(t, daemon, events, "nick3", "foo3")
+	joinRoom(t, conn2, "#foo")
+	joinRoom(t, conn2, "#bar")
+	joinRoom(t, conn1, "#foo")
+	joinRoom(t, conn1, "#bar")
+	expectMsg(t, conn2)
+	expectMsg(t, conn2)
+
+	conn1.inbound <- "PRIVMSG #foo,NICK3,#bar,nobody,#baz :hello"
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		got[expectMsg(t, conn2)] = true
+	}
+	for _, want := range []string{
+		":nick1!foo1@someclient PRIVMSG #foo :hello\r\n",
+		":nick1!foo1@someclient PRIVMSG #bar :hello\r\n",
+	} {
+		if !got[want] {
+			t.Fatal("message to room among multiple targets", got)
+		}
+	}
+	if r := expectMsg(t, conn3); r != ":nick1!foo1@someclient PRIVMSG nick3 :hello\r\n" {
+		t.Fatal("message to client among multiple targets", r)
+	}
+	if r := expectMsg(t, conn1); r != ":foohost 401 nick1 nobody :No such nick/channel\r\n" {
+		t.Fatal("missing client among multiple targets", r)
+	}
+	if r := expectMsg(t, conn1); r != ":foohost 403 nick1 #baz :No such channel\r\n" {
+		t.Fatal("missing room among multiple targets", r)
+	}
+}
+
+func TestOpAccounts(t *testing.T) {
+	log_sink := make(chan LogEvent, 32)
+	state_sink := make(chan StateEvent, 8)
+	daemon := NewDaemon("foohost", "", log_sink, state_sink)
+	daemon.AccountService = &fakeAccounts{reserved: map[string]string{"bot": "bot"}}
+	daemon.ReserveNicks = true
+	events := make(chan ClientEvent)
+	go daemon.Processor(events)
+
+	_, conn1 := registerClient(t, daemon, events, "nick1", "foo1")
+	joinRoom(t, conn1, "#foo")
+	conn2 := NewTestingConn()
+	client2 := NewClient("foohost", conn2)
+	go client2.Processor(events)
+	conn2.inbound <- "PASS secret\r\nNICK bot\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 7; i++ {
+		expectMsg(t, conn2)
+	}
+	joinRoom(t, conn2, "#foo")
+	expectMsg(t, conn1)
+
+	conn1.inbound <- "MODE #foo +o bot"
+	if r := expectMsg(t, conn1); r != ":nick1!foo1@someclient MODE #foo +o bot\r\n" {
+		t.Fatal("+o", r)
+	}
+	expectMsg(t, conn2)
+	state := <-state_sink
+	if len(state.op_accounts) != 1 || state.op_accounts[0] != "bot" {
+		t.Fatal("operator account is not saved", state)
+	}
+	conn1.inbound <- "MODE #foo +o nick1"
+	expectMsg(t, conn1)
+	expectMsg(t, conn2)
+	if len(state_sink) != 0 {
+		t.Fatal("anonymous operator is saved", <-state_sink)
+	}
+
+	conn2.inbound <- "PART #foo"
+	expectMsg(t, conn2)
+	expectMsg(t, conn1)
+	conn2.inbound <- "JOIN #foo"
+	expectNumeric(t, conn2, "331")
+	expectMsg(t, conn2)
+	expectNumeric(t, conn2, "353")
+	expectNumeric(t, conn2, "366")
+	if r := expectMsg(t, conn2); r != ":foohost MODE #foo +o bot\r\n" {
+		t.Fatal("operator status is not given back", r)
+	}
+	expectMsg(t, conn1)
+	if r := expectMsg(t, conn1); r != ":foohost MODE #foo +o bot\r\n" {
+		t.Fatal("operator status is not announced", r)
+	}
+
+	joinRoom(t, conn2, "#bar")
+	if len(state_sink) != 0 {
+		t.Fatal("room creator is saved", <-state_sink)
+	}
+	conn2.inbound <- "MODE #bar +o bot"
+	expectMsg(t, conn2)
+	if s := <-state_sink; len(s.op_accounts) != 1 {
+		t.Fatal("operator account is not saved", s)
+	}
+	conn2.inbound <- "PART #bar"
+	expectMsg(t, conn2)
+	if s := <-state_sink; len(s.op_accounts) != 0 {
+		t.Fatal("last operator account is not forgotten", s)
+	}
+
+	statedir, err := ioutil.TempDir("", "states")
+	if err != nil {
+		t.Fatalf("can not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(statedir)
+	states := make(chan StateEvent, 1)
+	states <- state
+	close(states)
+	StateKeeper(statedir, states)
+	daemon = NewDaemon("foohost", "", nil, nil)
+	if err := daemon.StatesLoad(statedir); err != nil {
+		t.Fatal("loading states", err)
+	}
+	if r := daemon.rooms["#foo"]; r == nil || !r.OpAccount("bot") {
+		t.Fatal("operator account is not loaded", r)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long helpers wait for expected message before failing the test
+const TEST_WAIT = 5 * time.Second
+
+// Read next message sent to connection, failing the test if there is
+// none during TEST_WAIT.
+func expectMsg(t *testing.T, conn *TestingConn) string {
+	t.Helper()
+	select {
+	case r := <-conn.outbound:
+		return r
+	case <-time.After(TEST_WAIT):
+		t.Fatal("no message received")
+	}
+	return ""
+}
+
+// Read next message sent to connection and check that it is a server
+// reply with specified numeric code.
+func expectNumeric(t *testing.T, conn *TestingConn, code string) string {
+	t.Helper()
+	r := expectMsg(t, conn)
+	if cols := strings.Fields(r); len(cols) < 2 || !strings.HasPrefix(cols[0], ":") || cols[1] != code {
+		t.Fatalf("expected %s numeric, got %q", code, r)
+	}
+	return r
+}
+
+// Check that registration succeeded and drain the whole welcome burst
+// up to the end of MOTD
+func expectWelcome(t *testing.T, conn *TestingConn) {
+	t.Helper()
+	expectNumeric(t, conn, "001")
+	for {
+		cols := strings.Fields(expectMsg(t, conn))
+		if len(cols) > 1 && (cols[1] == "376" || cols[1] == "422") {
+			break
+		}
+	}
+}
+
+// Create client connected to daemon, register it with specified
+// nickname and username and drain the welcome burst.
+func registerClient(t *testing.T, daemon *Daemon, events chan<- ClientEvent, nick, user string) (*Client, *TestingConn) {
+	t.Helper()
+	conn := NewTestingConn()
+	client := NewClient(daemon.hostname, conn)
+	go client.Processor(events)
+	conn.inbound <- "NICK " + nick + "\r\nUSER " + user + " bar baz :Long " + nick
+	expectWelcome(t, conn)
+	return client, conn
+}
+
+// Join the room and drain replies up to the end of NAMES list
+func joinRoom(t *testing.T, conn *TestingConn, room string) {
+	t.Helper()
+	conn.inbound <- "JOIN " + room
+	for {
+		cols := strings.Fields(expectMsg(t, conn))
+		if len(cols) > 1 && cols[1] == "366" {
+			break
+		}
+	}
+}